@@ -0,0 +1,290 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// ChangeKind is the kind of change made to a path
+type ChangeKind uint8
+
+// Possible changes
+const (
+	ChangeAdded ChangeKind = iota
+	ChangeModified
+	ChangeDeleted
+)
+
+// String returns the change kind name
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdded:
+		return "added"
+	case ChangeModified:
+		return "modified"
+	case ChangeDeleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// Change is a path changed between two directories
+// Modified paths tell what changed about them.
+type Change struct {
+	Path     string // slash separated path, starting with "/" at the directories
+	Kind     ChangeKind
+	Contents bool // type, contents, link target or device changed
+	Mode     bool // permissions changed
+	Owner    bool // user or group changed
+}
+
+// Changes returns the paths changed from directory oldDir to directory newDir, sorted by path
+// Paths are modified when their type, contents, link target, permissions or owner change,
+// directories only when their own permissions or owner do. Contents of added directories
+// are reported as added too, while deleted directories are reported alone. A directory
+// replaced by another type of file is reported as deleted and then added.
+func Changes(oldDir, newDir string) ([]Change, error) {
+
+	old := map[string]os.FileInfo{}
+	err := walkRelative(oldDir, func(rel string, fi os.FileInfo) error {
+		old[rel] = fi
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	err = walkRelative(newDir, func(rel string, fi os.FileInfo) error {
+		o, found := old[rel]
+		// directories replaced are left to be reported as deleted along with their contents
+		if !found || (o.IsDir() && !fi.IsDir()) {
+			changes = append(changes, Change{Path: "/" + rel, Kind: ChangeAdded})
+			return nil
+		}
+		delete(old, rel)
+
+		change, err := compare(filepath.Join(oldDir, rel), filepath.Join(newDir, rel), o, fi)
+		if err != nil {
+			return err
+		}
+		if change.Contents || change.Mode || change.Owner {
+			change.Path = "/" + rel
+			change.Kind = ChangeModified
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// what is left was deleted, only the topmost deleted directory is reported
+	for rel := range old {
+		if _, parentDeleted := old[filepath.ToSlash(filepath.Dir(rel))]; parentDeleted {
+			continue
+		}
+		changes = append(changes, Change{Path: "/" + rel, Kind: ChangeDeleted})
+	}
+
+	// a path deleted and added again is deleted first
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Path == changes[j].Path {
+			return changes[i].Kind == ChangeDeleted
+		}
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// walkRelative walks a directory calling fn with the slash separated relative path of every entry
+// The directory itself is not visited.
+func walkRelative(dir string, fn func(rel string, fi os.FileInfo) error) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		return fn(filepath.ToSlash(rel), fi)
+	})
+}
+
+// compare returns what changed about an entry between its old and new paths
+func compare(oldPath, newPath string, o, n os.FileInfo) (Change, error) {
+	var change Change
+
+	ost, ok1 := o.Sys().(*syscall.Stat_t)
+	nst, ok2 := n.Sys().(*syscall.Stat_t)
+	if ok1 && ok2 {
+		// hardlinked to the same file
+		if ost.Dev == nst.Dev && ost.Ino == nst.Ino {
+			return change, nil
+		}
+		change.Owner = ost.Uid != nst.Uid || ost.Gid != nst.Gid
+	}
+
+	if o.Mode()&os.ModeType != n.Mode()&os.ModeType {
+		change.Contents = true
+		return change, nil
+	}
+	change.Mode = o.Mode()&^os.ModeType != n.Mode()&^os.ModeType
+
+	switch {
+	case o.Mode()&os.ModeSymlink != 0:
+		oldLink, err := os.Readlink(oldPath)
+		if err != nil {
+			return change, err
+		}
+		newLink, err := os.Readlink(newPath)
+		if err != nil {
+			return change, err
+		}
+		change.Contents = oldLink != newLink
+	case o.Mode().IsRegular():
+		// copies keep modification times, contents are only read when they differ
+		if o.Size() != n.Size() {
+			change.Contents = true
+		} else if !o.ModTime().Equal(n.ModTime()) {
+			same, err := sameContents(oldPath, newPath)
+			if err != nil {
+				return change, err
+			}
+			change.Contents = !same
+		}
+	case o.Mode()&os.ModeDevice != 0 && ok1 && ok2:
+		change.Contents = ost.Rdev != nst.Rdev
+	}
+	return change, nil
+}
+
+// sameContents reports whether two files have the same contents
+func sameContents(path1, path2 string) (bool, error) {
+	f1, err := os.Open(path1)
+	if err != nil {
+		return false, err
+	}
+	defer f1.Close()
+	f2, err := os.Open(path2)
+	if err != nil {
+		return false, err
+	}
+	defer f2.Close()
+
+	b1 := make([]byte, copyBufferSize)
+	b2 := make([]byte, copyBufferSize)
+	for {
+		n1, err1 := io.ReadFull(f1, b1)
+		n2, err2 := io.ReadFull(f2, b2)
+		if n1 != n2 || !bytes.Equal(b1[:n1], b2[:n2]) {
+			return false, nil
+		}
+		if err1 == io.EOF || err1 == io.ErrUnexpectedEOF {
+			return err2 == io.EOF || err2 == io.ErrUnexpectedEOF, nil
+		}
+		if err1 != nil {
+			return false, err1
+		}
+		if err2 != nil {
+			return false, err2
+		}
+	}
+}
+
+// ArchiveChanges returns the paths changed in directory dir from the contents of an archive file
+// The archive is extracted to a temporary directory to be compared, see Changes.
+// A nil opts uses DefaultOptions.
+func ArchiveChanges(archive, dir string, opts *Options) ([]Change, error) {
+	tmp, err := ioutil.TempDir("", "fsisolate-changes")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err = ExtractFile(archive, tmp, opts); err != nil {
+		return nil, err
+	}
+	return Changes(tmp, dir)
+}
+
+// CreateLayer writes the changes made to a directory to an image layer tarball file
+// A nil opts uses the zero value options, see WriteLayer.
+func CreateLayer(dir string, changes []Change, tarball string, opts *CreateOptions) error {
+	file, err := os.Create(tarball)
+	if err != nil {
+		return err
+	}
+
+	if err = WriteLayer(file, dir, changes, opts); err != nil {
+		file.Close()
+		os.Remove(tarball)
+		return err
+	}
+	return file.Close()
+}
+
+// WriteLayer writes the changes made to a directory as an image layer tarball to a stream
+// Added and modified paths are written from dir as with WriteTarball, deleted paths as OCI
+// whiteouts, so that applying the layer with ApplyLayer over the old directory contents
+// reproduces dir. Changes must be sorted by path, as returned by Changes.
+// A nil opts uses the zero value options
+func WriteLayer(w io.Writer, dir string, changes []Change, opts *CreateOptions) error {
+
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+
+	cw, err := Compress(w, opts.Compression)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(cw)
+	links := map[inode]string{}
+
+	for _, c := range changes {
+		name := strings.TrimPrefix(c.Path, "/")
+
+		if c.Kind == ChangeDeleted {
+			whiteout := &tar.Header{
+				Name:     path.Join(path.Dir(name), whiteoutPrefix+path.Base(name)),
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+			}
+			if opts.ModTime != nil {
+				whiteout.ModTime = *opts.ModTime
+			}
+			if err = tw.WriteHeader(whiteout); err != nil {
+				return err
+			}
+			continue
+		}
+
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		fi, err := os.Lstat(file)
+		if err != nil {
+			return err
+		}
+		if err = writeEntry(tw, file, name, fi, opts, links); err != nil {
+			return err
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
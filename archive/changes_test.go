@@ -0,0 +1,115 @@
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChanges(t *testing.T) {
+
+	image := createTarball(t, []testEntry{
+		{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644}, body: "base\n"},
+		{header: tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644}, body: "root:x:0:0::/root:/bin/sh\n"},
+		{header: tar.Header{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644}, body: "hello\n"},
+		{header: tar.Header{Name: "etc/touched", Typeflag: tar.TypeReg, Mode: 0644}, body: "touched\n"},
+		{header: tar.Header{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 0755}, body: "tool"},
+		{header: tar.Header{Name: "bin/link", Typeflag: tar.TypeSymlink, Linkname: "tool"}},
+		{header: tar.Header{Name: "var/cache/a", Typeflag: tar.TypeReg, Mode: 0644}, body: "a"},
+		{header: tar.Header{Name: "var/cache/sub/b", Typeflag: tar.TypeReg, Mode: 0644}, body: "b"},
+		{header: tar.Header{Name: "srv/data/c", Typeflag: tar.TypeReg, Mode: 0644}, body: "c"},
+	})
+	defer os.Remove(image)
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create test directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDir, newDir := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	for _, d := range []string{oldDir, newDir} {
+		os.Mkdir(d, 0755)
+		if err = ExtractTarball(image, d); err != nil {
+			t.Fatalf("Error extracting image: %s", err)
+		}
+	}
+
+	// same size, different contents
+	ioutil.WriteFile(filepath.Join(newDir, "etc/hostname"), []byte("host\n"), 0644)
+	os.Remove(filepath.Join(newDir, "etc/motd"))
+	os.Chtimes(filepath.Join(newDir, "etc/touched"), time.Now(), time.Now())
+	os.Chmod(filepath.Join(newDir, "bin/tool"), 0700)
+	os.Remove(filepath.Join(newDir, "bin/link"))
+	os.Symlink("other", filepath.Join(newDir, "bin/link"))
+	os.RemoveAll(filepath.Join(newDir, "var/cache"))
+	os.MkdirAll(filepath.Join(newDir, "opt/new"), 0755)
+	ioutil.WriteFile(filepath.Join(newDir, "opt/new/file"), []byte("new\n"), 0644)
+	os.RemoveAll(filepath.Join(newDir, "srv/data"))
+	ioutil.WriteFile(filepath.Join(newDir, "srv/data"), []byte("data\n"), 0644)
+
+	changes, err := Changes(oldDir, newDir)
+	if err != nil {
+		t.Fatalf("Error getting changes: %s", err)
+	}
+
+	var testData = []struct {
+		path     string     // changed path
+		kind     ChangeKind // expected change
+		contents bool       // whether contents should be changed
+		mode     bool       // whether mode should be changed
+	}{
+		{"/bin/link", ChangeModified, true, false},
+		{"/bin/tool", ChangeModified, false, true},
+		{"/etc/hostname", ChangeModified, true, false},
+		{"/etc/motd", ChangeDeleted, false, false},
+		{"/opt", ChangeAdded, false, false},
+		{"/opt/new", ChangeAdded, false, false},
+		{"/opt/new/file", ChangeAdded, false, false},
+		{"/srv/data", ChangeDeleted, false, false},
+		{"/srv/data", ChangeAdded, false, false},
+		{"/var/cache", ChangeDeleted, false, false},
+	}
+
+	if len(changes) != len(testData) {
+		t.Fatalf("Got changes %+v but expected %+v", changes, testData)
+	}
+	for i, td := range testData {
+		c := changes[i]
+		if c.Path != td.path || c.Kind != td.kind || c.Contents != td.contents || c.Mode != td.mode || c.Owner {
+			t.Errorf("Change #%d is %+v but expected %s %s (contents %t, mode %t)", i, c, td.kind, td.path, td.contents, td.mode)
+		}
+	}
+
+	// extracting the archive reproduces the old directory
+	if archived, err := ArchiveChanges(image, newDir, nil); err != nil || len(archived) != len(changes) {
+		t.Errorf("Archive changes are %+v (%v) but expected %+v", archived, err, changes)
+	}
+
+	// applying the changes as a layer over the old contents reproduces the new directory
+	layer := filepath.Join(dir, "layer.tar")
+	if err = CreateLayer(newDir, changes, layer, nil); err != nil {
+		t.Fatalf("Error creating layer: %s", err)
+	}
+	file, err := os.Open(layer)
+	if err != nil {
+		t.Fatalf("Couldn't open layer: %s", err)
+	}
+	defer file.Close()
+	if err = ApplyLayer(context.Background(), file, oldDir, nil); err != nil {
+		t.Fatalf("Error applying layer: %s", err)
+	}
+	if changes, err = Changes(oldDir, newDir); err != nil || len(changes) != 0 {
+		t.Errorf("Directory with layer applied has changes %+v (%v)", changes, err)
+	}
+
+	// a directory compared to itself didn't change
+	if changes, err = Changes(oldDir, oldDir); err != nil || len(changes) != 0 {
+		t.Errorf("Directory compared to itself returned changes %+v (%v)", changes, err)
+	}
+}
@@ -0,0 +1,136 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression is the compression algorithm applied to an archive stream
+type Compression uint8
+
+// Compression algorithms detected
+const (
+	Uncompressed Compression = iota
+	Gzip
+	Bzip2
+	Xz
+	Zstd
+)
+
+// magic bytes at the start of each compressed stream
+var compressionMagic = []struct {
+	compression Compression
+	magic       []byte
+}{
+	{Gzip, []byte{0x1f, 0x8b}},
+	{Bzip2, []byte{'B', 'Z', 'h'}},
+	{Xz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{Zstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// String returns the compression name
+func (c Compression) String() string {
+	switch c {
+	case Uncompressed:
+		return "uncompressed"
+	case Gzip:
+		return "gzip"
+	case Bzip2:
+		return "bzip2"
+	case Xz:
+		return "xz"
+	case Zstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("Compression(%d)", c)
+}
+
+// DetectCompression sniffs the compression algorithm from the magic bytes at the head of a stream
+// The reader is not advanced
+func DetectCompression(r *bufio.Reader) (Compression, error) {
+	for _, cm := range compressionMagic {
+		head, err := r.Peek(len(cm.magic))
+		if err != nil && err != io.EOF {
+			return Uncompressed, err
+		}
+		if bytes.Equal(head, cm.magic) {
+			return cm.compression, nil
+		}
+	}
+	return Uncompressed, nil
+}
+
+// Decompress returns a reader that transparently decompresses the stream
+// Compression is detected from the stream contents, not from the file name.
+// Uncompressed streams are returned as is.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	c, err := DetectCompression(br)
+	if err != nil {
+		return nil, fmt.Errorf("Error detecting compression: %s", err.Error())
+	}
+
+	switch c {
+	case Gzip:
+		return gzip.NewReader(br)
+	case Bzip2:
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+	case Xz:
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	case Zstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// nopWriteCloser adds a no-op Close to a writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Close does nothing
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Compress returns a writer that compresses data written to it
+// Closing the returned writer flushes the compressed stream but doesn't close w.
+// bzip2 compression is not supported.
+func Compress(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case Uncompressed:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Xz:
+		xw, err := xz.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return xw, nil
+	case Zstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return zw, nil
+	}
+	return nil, fmt.Errorf("Error compressing: %s compression not supported", c)
+}
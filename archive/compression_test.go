@@ -0,0 +1,134 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDetectCompression(t *testing.T) {
+
+	var testData = []struct {
+		file        string      // archive file to sniff
+		compression Compression // expected compression
+	}{
+		{"testdata/text.tar", Uncompressed},
+		{"testdata/text.tar.gz", Gzip},
+		{"testdata/text.tar.bz2", Bzip2},
+		{"testdata/text.tar.xz", Xz},
+		{"testdata/text.tar.zst", Zstd},
+	}
+
+	for _, td := range testData {
+
+		f, err := os.Open(td.file)
+		if err != nil {
+			t.Errorf("Couldn't open file %q: %s", td.file, err)
+			continue
+		}
+		defer f.Close()
+
+		c, err := DetectCompression(bufio.NewReader(f))
+		if err != nil {
+			t.Errorf("Error detecting compression for %q: %s", td.file, err)
+			continue
+		}
+
+		if c != td.compression {
+			t.Errorf("Detected compression for %q was %q but expected %q", td.file, c, td.compression)
+		}
+	}
+}
+
+func TestDecompress(t *testing.T) {
+
+	expected, err := ioutil.ReadFile("testdata/text.tar")
+	if err != nil {
+		t.Fatalf("Couldn't read uncompressed tarball: %s", err)
+	}
+
+	for _, file := range []string{"testdata/text.tar", "testdata/text.tar.gz", "testdata/text.tar.bz2", "testdata/text.tar.xz", "testdata/text.tar.zst"} {
+
+		f, err := os.Open(file)
+		if err != nil {
+			t.Errorf("Couldn't open file %q: %s", file, err)
+			continue
+		}
+		defer f.Close()
+
+		dr, err := Decompress(f)
+		if err != nil {
+			t.Errorf("Error decompressing %q: %s", file, err)
+			continue
+		}
+
+		content, err := ioutil.ReadAll(dr)
+		dr.Close()
+		if err != nil {
+			t.Errorf("Error reading decompressed stream for %q: %s", file, err)
+			continue
+		}
+
+		if string(content) != string(expected) {
+			t.Errorf("Decompressed contents for %q don't match the uncompressed tarball", file)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+
+	var testData = []struct {
+		compression Compression // compression to apply
+		compressOK  bool        // whether compression is supported
+	}{
+		{Uncompressed, true},
+		{Gzip, true},
+		{Bzip2, false},
+		{Xz, true},
+		{Zstd, true},
+	}
+
+	for _, td := range testData {
+
+		var buf bytes.Buffer
+		cw, err := Compress(&buf, td.compression)
+		if err != nil {
+			if td.compressOK {
+				t.Errorf("Error compressing with %s: %s", td.compression, err)
+			}
+			continue
+		}
+		if !td.compressOK {
+			t.Errorf("Compressing with %s should have failed, but did not", td.compression)
+			continue
+		}
+
+		if _, err = cw.Write([]byte("Die Zeit vergeht wie im Fluge")); err != nil {
+			t.Errorf("Error writing %s stream: %s", td.compression, err)
+			continue
+		}
+		if err = cw.Close(); err != nil {
+			t.Errorf("Error closing %s stream: %s", td.compression, err)
+			continue
+		}
+
+		// compressed data must be detected and decompressed back
+		c, err := DetectCompression(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+		if err != nil || c != td.compression {
+			t.Errorf("Compressed stream detected as %s (%v) but expected %s", c, err, td.compression)
+			continue
+		}
+		dr, err := Decompress(&buf)
+		if err != nil {
+			t.Errorf("Error decompressing %s stream: %s", td.compression, err)
+			continue
+		}
+		content, err := ioutil.ReadAll(dr)
+		dr.Close()
+		if err != nil || string(content) != "Die Zeit vergeht wie im Fluge" {
+			t.Errorf("Decompressed %s stream contains %q (%v)", td.compression, content, err)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package archive
+
+import (
+	"context"
+	"io"
+)
+
+// contextReader fails reads once its context is done
+// Extraction reads its stream all along, so it stops at the next read after cancellation.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read implements io.Reader
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// withContext returns a reader for r that stops when ctx is done
+func withContext(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		return r
+	}
+	return &contextReader{ctx: ctx, r: r}
+}
+
+// contextError returns the context error instead of err if the context is done
+// Readers wrap errors in their own, this way callers get context errors as is.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,229 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cpio newc format constants
+const (
+	cpioHeaderSize = 110
+	cpioTrailer    = "TRAILER!!!"
+	cpioMaxPath    = 4096 // PATH_MAX, longest entry name or symlink target accepted
+)
+
+// cpio file type bits, same as st_mode
+const (
+	cpioTypeMask    = 0170000
+	cpioTypeSocket  = 0140000
+	cpioTypeSymlink = 0120000
+	cpioTypeReg     = 0100000
+	cpioTypeBlock   = 0060000
+	cpioTypeDir     = 0040000
+	cpioTypeChar    = 0020000
+	cpioTypeFifo    = 0010000
+)
+
+// cpioLink identifies hardlinked entries
+type cpioLink struct {
+	devmajor, devminor, ino int64
+}
+
+// cpioReader returns the entries of a newc cpio archive as tar headers
+// Hardlinked files store their contents only in the last entry of the group,
+// so earlier entries are held until the contents show up and then returned as links.
+type cpioReader struct {
+	r       io.Reader
+	current io.Reader
+	pad     int64
+	pending map[cpioLink][]*tar.Header
+	queue   []*tar.Header
+}
+
+// matchCpio detects newc cpio archives, with and without checksum
+func matchCpio(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("070701")) || bytes.HasPrefix(head, []byte("070702"))
+}
+
+// openCpio returns the entries in a cpio archive
+func openCpio(r io.Reader) (EntryReader, error) {
+	return &cpioReader{r: r, pending: map[cpioLink][]*tar.Header{}}, nil
+}
+
+// Next advances to the next cpio entry
+func (c *cpioReader) Next() (*tar.Header, error) {
+	for {
+		// skip unread contents of the previous entry and its padding
+		if c.current != nil {
+			if _, err := io.Copy(ioutil.Discard, c.current); err != nil {
+				return nil, err
+			}
+			c.current = nil
+		}
+		if c.pad > 0 {
+			if _, err := io.CopyN(ioutil.Discard, c.r, c.pad); err != nil {
+				return nil, err
+			}
+			c.pad = 0
+		}
+
+		// links held until their contents showed up go first
+		if len(c.queue) > 0 {
+			header := c.queue[0]
+			c.queue = c.queue[1:]
+			return header, nil
+		}
+
+		header, link, nlink, err := c.readHeader()
+		if err == io.EOF {
+			c.flushPending()
+			if len(c.queue) > 0 {
+				continue
+			}
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header == nil {
+			continue
+		}
+
+		if header.Typeflag != tar.TypeReg || nlink < 2 {
+			return header, nil
+		}
+
+		// hardlink group: hold entries without contents
+		if header.Size == 0 {
+			c.pending[link] = append(c.pending[link], header)
+			continue
+		}
+		for _, h := range c.pending[link] {
+			h.Typeflag = tar.TypeLink
+			h.Linkname = header.Name
+			c.queue = append(c.queue, h)
+		}
+		delete(c.pending, link)
+		return header, nil
+	}
+}
+
+// flushPending returns hardlink groups that never got contents as empty files and links
+func (c *cpioReader) flushPending() {
+	for link, headers := range c.pending {
+		for _, h := range headers[1:] {
+			h.Typeflag = tar.TypeLink
+			h.Linkname = headers[0].Name
+		}
+		c.queue = append(c.queue, headers...)
+		delete(c.pending, link)
+	}
+}
+
+// readHeader reads a newc header and its name, leaving the stream at the entry contents
+// Entries that can't be extracted are returned as a nil header.
+func (c *cpioReader) readHeader() (*tar.Header, cpioLink, int64, error) {
+	var link cpioLink
+
+	raw := make([]byte, cpioHeaderSize)
+	if _, err := io.ReadFull(c.r, raw); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, link, 0, fmt.Errorf("truncated cpio header")
+		}
+		return nil, link, 0, err
+	}
+	if !matchCpio(raw) {
+		return nil, link, 0, fmt.Errorf("invalid cpio header magic %q", raw[:6])
+	}
+
+	// 13 hexadecimal fields of 8 characters after the magic
+	var fields [13]int64
+	for i := range fields {
+		v, err := strconv.ParseInt(string(raw[6+i*8:14+i*8]), 16, 64)
+		if err != nil {
+			return nil, link, 0, fmt.Errorf("invalid cpio header field: %s", err.Error())
+		}
+		fields[i] = v
+	}
+	ino, mode, uid, gid, nlink, mtime, size := fields[0], fields[1], fields[2], fields[3], fields[4], fields[5], fields[6]
+	devmajor, devminor, rdevmajor, rdevminor, namesize := fields[7], fields[8], fields[9], fields[10], fields[11]
+
+	// sizes come from the archive, don't let them decide how much is allocated
+	if namesize > cpioMaxPath {
+		return nil, link, 0, fmt.Errorf("cpio entry name size %d exceeds %d bytes", namesize, cpioMaxPath)
+	}
+	name := make([]byte, namesize)
+	if _, err := io.ReadFull(c.r, name); err != nil {
+		return nil, link, 0, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, c.r, pad4(cpioHeaderSize+namesize)); err != nil {
+		return nil, link, 0, err
+	}
+
+	header := &tar.Header{
+		Name:     strings.TrimRight(string(name), "\x00"),
+		Mode:     mode & 07777,
+		Uid:      int(uid),
+		Gid:      int(gid),
+		ModTime:  time.Unix(mtime, 0),
+		Devmajor: rdevmajor,
+		Devminor: rdevminor,
+	}
+	if header.Name == cpioTrailer {
+		return nil, link, 0, io.EOF
+	}
+
+	c.current = io.LimitReader(c.r, size)
+	c.pad = pad4(size)
+
+	switch mode & cpioTypeMask {
+	case cpioTypeReg:
+		header.Typeflag = tar.TypeReg
+		header.Size = size
+	case cpioTypeDir:
+		header.Typeflag = tar.TypeDir
+	case cpioTypeSymlink:
+		header.Typeflag = tar.TypeSymlink
+		if size > cpioMaxPath {
+			return nil, link, 0, fmt.Errorf("cpio symlink target size %d for %q exceeds %d bytes", size, header.Name, cpioMaxPath)
+		}
+		target, err := ioutil.ReadAll(c.current)
+		if err != nil {
+			return nil, link, 0, err
+		}
+		header.Linkname = string(target)
+	case cpioTypeChar:
+		header.Typeflag = tar.TypeChar
+	case cpioTypeBlock:
+		header.Typeflag = tar.TypeBlock
+	case cpioTypeFifo:
+		header.Typeflag = tar.TypeFifo
+	case cpioTypeSocket:
+		// sockets can't be restored
+		return nil, link, 0, nil
+	default:
+		return nil, link, 0, fmt.Errorf("unknown cpio entry type %o for %q", mode&cpioTypeMask, header.Name)
+	}
+
+	link = cpioLink{devmajor: devmajor, devminor: devminor, ino: ino}
+	return header, link, nlink, nil
+}
+
+// Read reads the current entry contents
+func (c *cpioReader) Read(p []byte) (int, error) {
+	if c.current == nil {
+		return 0, io.EOF
+	}
+	return c.current.Read(p)
+}
+
+// pad4 returns the padding needed to align n to 4 bytes
+func pad4(n int64) int64 {
+	return (4 - n%4) % 4
+}
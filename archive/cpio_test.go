@@ -0,0 +1,55 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// cpioHeader returns a newc header followed by its name, padded to 4 bytes
+func cpioHeader(mode, size, namesize int64, name string) string {
+	h := fmt.Sprintf("070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+		1, mode, 0, 0, 1, 0, size, 0, 0, 0, 0, namesize, 0)
+	h += name
+	for len(h)%4 != 0 {
+		h += "\x00"
+	}
+	return h
+}
+
+func TestCpioLimits(t *testing.T) {
+
+	var testData = []struct {
+		archive string // raw archive contents
+		nextOK  bool   // whether reading the first entry should succeed
+	}{
+		{cpioHeader(cpioTypeSymlink|0777, 6, 5, "link\x00") + "target", true},
+		{cpioHeader(cpioTypeReg|0644, 0, 0xFFFFFFFF, "huge"), false},
+		{cpioHeader(cpioTypeSymlink|0777, 0xFFFFFFF0, 5, "link\x00") + "target", false},
+		{cpioHeader(cpioTypeSymlink|0777, cpioMaxPath+1, 5, "link\x00") + strings.Repeat("x", cpioMaxPath+1), false},
+	}
+
+	for i, td := range testData {
+
+		r, err := openCpio(bytes.NewReader([]byte(td.archive)))
+		if err != nil {
+			t.Fatalf("Error opening cpio archive: %s", err)
+		}
+
+		header, err := r.Next()
+		if err != nil {
+			if td.nextOK {
+				t.Errorf("Reading cpio archive #%d returned an error: %s", i, err)
+			}
+			continue
+		}
+		if !td.nextOK {
+			t.Errorf("Reading cpio archive #%d should have failed, but returned %+v", i, header)
+			continue
+		}
+		if header.Name != "link" || header.Linkname != "target" {
+			t.Errorf("Cpio archive #%d entry is %q -> %q", i, header.Name, header.Linkname)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// CreateOptions configures tarball creation
+// The zero value is ready to use and writes an uncompressed tarball keeping files metadata.
+type CreateOptions struct {
+	Compression    Compression // compression applied to the tarball
+	ModTime        *time.Time  // when set every entry gets this modification time
+	NumericOwner   bool        // don't store user and group names, only their ids
+	NormalizeOwner bool        // store every entry as owned by uid and gid 0
+}
+
+// inode identifies a file in a filesystem, used to detect hardlinks
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// CreateTarball writes the contents of a directory to a tarball file
+// A nil opts uses the zero value options
+func CreateTarball(dir string, tarball string, opts *CreateOptions) error {
+
+	file, err := os.Create(tarball)
+	if err != nil {
+		return err
+	}
+
+	if err = WriteTarball(file, dir, opts); err != nil {
+		file.Close()
+		os.Remove(tarball)
+		return err
+	}
+	return file.Close()
+}
+
+// WriteTarball writes the contents of a directory as a tarball to a stream
+// Output is deterministic: entries are sorted by name and access and change times are not stored.
+// Symlinks are stored as such, files sharing an inode are stored as hardlinks.
+// The directory itself is not part of the tarball, only its contents.
+// A nil opts uses the zero value options
+func WriteTarball(w io.Writer, dir string, opts *CreateOptions) error {
+
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+
+	cw, err := Compress(w, opts.Compression)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(cw)
+	links := map[inode]string{}
+
+	// Walk visits entries in lexical order
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		return writeEntry(tw, path, filepath.ToSlash(rel), fi, opts, links)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// writeEntry writes a file to a tarball with an entry name
+// Files whose inode was already written are stored as hardlinks to it.
+func writeEntry(tw *tar.Writer, path, name string, fi os.FileInfo, opts *CreateOptions, links map[inode]string) error {
+
+	// sockets can't be archived
+	if fi.Mode()&os.ModeSocket != 0 {
+		return nil
+	}
+
+	var link string
+	var err error
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if fi.IsDir() {
+		header.Name += "/"
+	}
+
+	// times other than modification change on every read
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	if opts.ModTime != nil {
+		header.ModTime = *opts.ModTime
+	}
+	if opts.NumericOwner || opts.NormalizeOwner {
+		header.Uname = ""
+		header.Gname = ""
+	}
+	if opts.NormalizeOwner {
+		header.Uid = 0
+		header.Gid = 0
+	}
+
+	// files already written with the same inode are stored as hardlinks
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() && st.Nlink > 1 {
+		id := inode{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+		if first, found := links[id]; found {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = first
+			header.Size = 0
+		} else {
+			links[id] = header.Name
+		}
+	}
+
+	if err = tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(tw, file)
+	return err
+}
@@ -0,0 +1,141 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreateTarball(t *testing.T) {
+
+	source, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create source directory: %s", err)
+	}
+	defer os.RemoveAll(source)
+
+	if err = ExtractTarball("testdata/busybox.tar", source); err != nil {
+		t.Fatalf("Couldn't extract source tree: %s", err)
+	}
+
+	mtime := time.Date(2016, 5, 13, 0, 0, 0, 0, time.UTC)
+
+	var testData = []struct {
+		opts     CreateOptions // creation options
+		createOK bool          // whether creation should succeed
+	}{
+		{CreateOptions{}, true},
+		{CreateOptions{Compression: Gzip, ModTime: &mtime, NormalizeOwner: true}, true},
+		{CreateOptions{Compression: Zstd, ModTime: &mtime, NumericOwner: true}, true},
+		{CreateOptions{Compression: Bzip2}, false},
+	}
+
+	for _, td := range testData {
+
+		file, err := ioutil.TempFile("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create tarball file: %s", err)
+		}
+		file.Close()
+		tarball := file.Name()
+		defer os.Remove(tarball)
+
+		err = CreateTarball(source, tarball, &td.opts)
+		if err != nil {
+			if td.createOK {
+				t.Errorf("Error creating tarball with options %+v: %s", td.opts, err)
+			}
+			continue
+		}
+
+		if !td.createOK {
+			t.Errorf("Creating tarball with options %+v should have failed, but did not", td.opts)
+			continue
+		}
+
+		target, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create target directory: %s", err)
+		}
+		defer os.RemoveAll(target)
+
+		if err = ExtractTarball(tarball, target); err != nil {
+			t.Errorf("Error extracting created tarball with options %+v: %s", td.opts, err)
+			continue
+		}
+
+		if link, err := os.Readlink(filepath.Join(target, "lib")); err != nil || link != "usr/lib" {
+			t.Errorf("Symlink lib points to %q (%v) but expected %q", link, err, "usr/lib")
+		}
+
+		ls, err1 := os.Stat(filepath.Join(target, "bin/ls"))
+		busybox, err2 := os.Stat(filepath.Join(target, "bin/busybox"))
+		if err1 != nil || err2 != nil || !os.SameFile(ls, busybox) {
+			t.Errorf("Hardlink bin/ls is not the same file as bin/busybox with options %+v", td.opts)
+		} else if busybox.Mode().Perm() != 0755 {
+			t.Errorf("File bin/busybox has mode %v but expected %v", busybox.Mode().Perm(), os.FileMode(0755))
+		}
+
+		if td.opts.ModTime != nil && !busybox.ModTime().Equal(mtime) {
+			t.Errorf("File bin/busybox has modification time %s but expected %s", busybox.ModTime(), mtime)
+		}
+	}
+}
+
+func TestWriteTarballDeterministic(t *testing.T) {
+
+	source, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create source directory: %s", err)
+	}
+	defer os.RemoveAll(source)
+
+	if err = ExtractTarball("testdata/busybox.tar", source); err != nil {
+		t.Fatalf("Couldn't extract source tree: %s", err)
+	}
+
+	mtime := time.Date(2016, 5, 13, 0, 0, 0, 0, time.UTC)
+	opts := &CreateOptions{Compression: Gzip, ModTime: &mtime, NormalizeOwner: true}
+
+	var first bytes.Buffer
+	if err = WriteTarball(&first, source, opts); err != nil {
+		t.Fatalf("Error writing tarball: %s", err)
+	}
+
+	// modification times are normalized
+	now := time.Now()
+	if err = os.Chtimes(filepath.Join(source, "bin/busybox"), now, now); err != nil {
+		t.Fatalf("Couldn't change file times: %s", err)
+	}
+
+	var second bytes.Buffer
+	if err = WriteTarball(&second, source, opts); err != nil {
+		t.Fatalf("Error writing tarball: %s", err)
+	}
+
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Errorf("Tarballs written from the same directory differ")
+	}
+
+	// entries are sorted
+	dr, err := Decompress(&first)
+	if err != nil {
+		t.Fatalf("Error decompressing tarball: %s", err)
+	}
+	tr := tar.NewReader(dr)
+	previous := ""
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if header.Name < previous {
+			t.Errorf("Entry %q written after %q", header.Name, previous)
+		}
+		previous = header.Name
+	}
+}
@@ -0,0 +1,79 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// ar format constants
+const (
+	arMagic      = "!<arch>\n"
+	arHeaderSize = 60
+)
+
+// debDataPrefix is the name prefix of the deb member holding the package files
+const debDataPrefix = "data.tar"
+
+// debReader returns the entries of a deb package data payload
+type debReader struct {
+	*tar.Reader
+	payload io.ReadCloser
+}
+
+// matchDeb detects deb packages, which are ar archives starting with a debian-binary member
+func matchDeb(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(arMagic+"debian-binary"))
+}
+
+// openDeb skips ar members up to the data payload and returns the payload entries
+func openDeb(r io.Reader) (EntryReader, error) {
+
+	magic := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != arMagic {
+		return nil, fmt.Errorf("invalid ar magic %q", magic)
+	}
+
+	header := make([]byte, arHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("no %s member found in deb package", debDataPrefix)
+			}
+			return nil, err
+		}
+
+		// GNU ar terminates names with a slash
+		name := strings.TrimRight(strings.TrimSpace(string(header[0:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ar member size for %q: %s", name, err.Error())
+		}
+
+		if strings.HasPrefix(name, debDataPrefix) {
+			// payload might be compressed with any supported algorithm
+			payload, err := Decompress(io.LimitReader(r, size))
+			if err != nil {
+				return nil, err
+			}
+			return &debReader{Reader: tar.NewReader(payload), payload: payload}, nil
+		}
+
+		// members are aligned to 2 bytes
+		if _, err = io.CopyN(ioutil.Discard, r, size+size%2); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Close releases the payload decompressor
+func (d *debReader) Close() error {
+	return d.payload.Close()
+}
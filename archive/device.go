@@ -0,0 +1,44 @@
+package archive
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// errDeviceUnsupported is returned by FailDevice fallbacks
+var errDeviceUnsupported = errors.New("device nodes can't be created")
+
+// MakeDevice creates a character or block device node with the type and permissions of mode
+// Device nodes are only created when running privileged. Otherwise, or when privileged but not
+// allowed to, as inside user namespaces, fallback is applied.
+func MakeDevice(path string, mode os.FileMode, major, minor uint32, fallback DeviceFallback) error {
+	if os.Geteuid() == 0 {
+		devType := uint32(unix.S_IFBLK)
+		if mode&os.ModeCharDevice != 0 {
+			devType = unix.S_IFCHR
+		}
+		err := mknod(path, devType|uint32(mode.Perm()), major, minor)
+		if err != syscall.EPERM {
+			return err
+		}
+	}
+	return deviceFallback(path, mode, fallback)
+}
+
+// deviceFallback applies fallback in place of a device node that can't be created
+func deviceFallback(path string, mode os.FileMode, fallback DeviceFallback) error {
+	switch fallback {
+	case EmptyFileDevice:
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+		if err != nil {
+			return err
+		}
+		return file.Close()
+	case FailDevice:
+		return errDeviceUnsupported
+	}
+	return nil
+}
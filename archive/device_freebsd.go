@@ -0,0 +1,8 @@
+package archive
+
+import "golang.org/x/sys/unix"
+
+// mknod creates a device node, freebsd device numbers are 64 bits wide
+func mknod(path string, mode uint32, major, minor uint32) error {
+	return unix.Mknod(path, mode, unix.Mkdev(major, minor))
+}
@@ -0,0 +1,10 @@
+//go:build !freebsd
+
+package archive
+
+import "golang.org/x/sys/unix"
+
+// mknod creates a device node
+func mknod(path string, mode uint32, major, minor uint32) error {
+	return unix.Mknod(path, mode, int(unix.Mkdev(major, minor)))
+}
@@ -0,0 +1,13 @@
+package archive
+
+import "golang.org/x/sys/unix"
+
+// exchange atomically exchanges two paths
+// Paths on different filesystems can't be exchanged either.
+func exchange(a, b string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+	if err == unix.ENOSYS || err == unix.EINVAL || err == unix.EXDEV {
+		return errExchangeUnsupported
+	}
+	return err
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package archive
+
+// exchange fails, paths are only exchanged atomically on linux
+func exchange(a, b string) error {
+	return errExchangeUnsupported
+}
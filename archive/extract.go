@@ -2,19 +2,85 @@ package archive
 
 import (
 	"archive/tar"
+	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
 )
 
-// ExtractTarball extracts a tarball to a target directory
-// Compressed formats are not supported
-// TODO if extraction fails halfway, defer to delete remaining files
+// DeviceFallback is what extraction does with device nodes that can't be created
+type DeviceFallback uint8
+
+// Fallbacks for device nodes
+const (
+	SkipDevice      DeviceFallback = iota // ignore the entry
+	EmptyFileDevice                       // create an empty regular file in place of the device
+	FailDevice                            // abort extraction
+)
+
+// copyBufferSize is the size of the buffer used to write files contents
+const copyBufferSize = 32 * 1024
+
+// xattrPrefix is the PAX record prefix for extended attributes
+const xattrPrefix = "SCHILY.xattr."
+
+// capabilityXattr is the extended attribute holding file capabilities
+const capabilityXattr = "security.capability"
+
+// Options configures archive extraction
+// The zero value is ready to use and restores nothing but permission bits.
+// Restoring ownership, capabilities and most extended attributes requires privileges.
+type Options struct {
+	NoDevices            bool           // never create device nodes, even when privileged
+	DeviceFallback       DeviceFallback // what to do with device nodes when they can't be created
+	PreserveOwner        bool           // restore uid and gid
+	PreserveTimes        bool           // restore access and modification times
+	PreserveSpecialBits  bool           // restore setuid, setgid and sticky bits
+	PreserveXattrs       bool           // restore extended attributes from PAX records, except capabilities
+	PreserveCapabilities bool           // restore security.capability extended attribute
+	InPlace              bool           // extract straight into the target directory merging with its contents
+	Whiteouts            bool           // apply OCI whiteout entries to existing contents instead of extracting them
+	Fsync                bool           // flush every regular file to disk once written
+}
+
+// DefaultOptions returns the options used when none are provided
+// Everything is restored when running privileged, only times and mode bits otherwise.
+func DefaultOptions() *Options {
+	privileged := os.Geteuid() == 0
+	return &Options{
+		PreserveOwner:        privileged,
+		PreserveTimes:        true,
+		PreserveSpecialBits:  true,
+		PreserveXattrs:       privileged,
+		PreserveCapabilities: privileged,
+	}
+}
+
+// ExtractTarball extracts a tarball to a target directory using default options
+// gzip, bzip2, xz and zstd compressed tarballs are decompressed on the fly
+// Previous contents of the target directory are replaced by the tarball contents once extracted,
+// they are no longer merged with them. Use ExtractTarballWithOptions with Options.InPlace to merge.
 func ExtractTarball(tarball string, targetDir string) error {
+	return ExtractTarballWithOptions(tarball, targetDir, nil)
+}
+
+// ExtractTarballWithOptions extracts a tarball to a target directory
+// A nil opts uses DefaultOptions
+func ExtractTarballWithOptions(tarball string, targetDir string, opts *Options) error {
+	return ExtractTarballContext(context.Background(), tarball, targetDir, opts)
+}
+
+// ExtractTarballContext extracts a tarball to a target directory until ctx is done
+// A nil opts uses DefaultOptions, see ExtractReaderContext for cancellation behavior.
+func ExtractTarballContext(ctx context.Context, tarball string, targetDir string, opts *Options) error {
 
 	// check that target directory exists
-	_, err := os.Stat(targetDir)
-	if err != nil {
+	if _, err := os.Stat(targetDir); err != nil {
 		return err
 	}
 
@@ -25,7 +91,86 @@ func ExtractTarball(tarball string, targetDir string) error {
 	}
 	defer tbRead.Close()
 
-	tr := tar.NewReader(tbRead)
+	return ExtractReaderContext(ctx, tbRead, targetDir, opts)
+}
+
+// ExtractReader extracts a tarball read from a stream to a target directory in a single pass
+// gzip, bzip2, xz and zstd compressed streams are decompressed on the fly.
+// The stream is read until its end even if the tarball ends earlier.
+// A nil opts uses DefaultOptions
+// Unless opts.InPlace is set the tarball is extracted to a staging directory, which
+// replaces the target directory contents only if extraction succeeds. See ReplaceDir.
+func ExtractReader(r io.Reader, targetDir string, opts *Options) error {
+	return ExtractReaderContext(context.Background(), r, targetDir, opts)
+}
+
+// ExtractReaderContext extracts a tarball read from a stream until ctx is done
+// On cancellation the context error is returned and, unless opts.InPlace is set,
+// the target directory is left untouched.
+func ExtractReaderContext(ctx context.Context, r io.Reader, targetDir string, opts *Options) error {
+
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+
+	// check that target directory exists
+	if _, err := os.Stat(targetDir); err != nil {
+		return err
+	}
+
+	// detect compression from contents, not the extension
+	cr := withContext(ctx, r)
+	dr, err := Decompress(cr)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer dr.Close()
+
+	return extractStaged(ctx, targetDir, opts, func(dir string) error {
+		if err := extractEntries(tar.NewReader(dr), dir, opts); err != nil {
+			return err
+		}
+		// consume trailing padding and data after compressed streams so that the whole stream is read
+		if _, err := io.Copy(ioutil.Discard, dr); err != nil {
+			return err
+		}
+		_, err := io.Copy(ioutil.Discard, cr)
+		return err
+	})
+}
+
+// extractStaged runs extract on a staging directory and replaces targetDir contents with it on success
+// See ReplaceDir for how the replacement is made.
+func extractStaged(ctx context.Context, targetDir string, opts *Options, extract func(dir string) error) error {
+
+	if opts.InPlace {
+		return contextError(ctx, extract(targetDir))
+	}
+	return replaceDir(ctx, targetDir, opts.Fsync, extract)
+}
+
+// syncDir flushes a directory entries to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// extractEntries extracts every entry from an archive into dir
+func extractEntries(tr EntryReader, targetDir string, opts *Options) error {
+
+	// directories metadata is restored once their contents are in place
+	var dirs []*tar.Header
+
+	// paths written by this archive, whiteouts only apply to previous contents
+	unpacked := map[string]bool{}
+
+	// copy buffer shared by every file in the archive
+	buf := make([]byte, copyBufferSize)
+
 	for {
 		header, err := tr.Next()
 		if err == io.EOF {
@@ -38,30 +183,213 @@ func ExtractTarball(tarball string, targetDir string) error {
 			return err
 		}
 
-		path := filepath.Join(targetDir, header.Name)
-		fi := header.FileInfo()
+		// entries can never be written outside target directory
+		path, err := securePath(targetDir, header.Name)
+		if err != nil {
+			return err
+		}
+
+		// whiteouts remove previous layers entries instead of being extracted
+		if opts.Whiteouts {
+			if strings.HasPrefix(filepath.Base(path), whiteoutPrefix) {
+				if err = applyWhiteout(path, unpacked); err != nil {
+					return err
+				}
+				continue
+			}
+			for p := path; p != filepath.Clean(targetDir) && !unpacked[p]; p = filepath.Dir(p) {
+				unpacked[p] = true
+			}
+		}
 
 		// restore dir
-		if fi.IsDir() {
-			if err = os.MkdirAll(path, fi.Mode()); err != nil {
+		if header.Typeflag == tar.TypeDir {
+			if lfi, err := os.Lstat(path); err == nil && !lfi.IsDir() {
+				if err = os.Remove(path); err != nil {
+					return err
+				}
+			}
+			if err = os.MkdirAll(path, 0755); err != nil {
 				return err
 			}
+			dirs = append(dirs, header)
 			continue
 		}
 
-		// restore file
-		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode())
-		if err != nil {
+		// parent directories might not be present in the tarball
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 			return err
 		}
 
-		// write file contents
-		defer file.Close()
-		_, err = io.Copy(file, tr)
+		// replace any existing entry instead of writing through a symlink or hardlink
+		if lfi, err := os.Lstat(path); err == nil && !lfi.IsDir() {
+			if err = os.Remove(path); err != nil {
+				return err
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeGNUSparse:
+			if err = extractFile(tr, path, buf, opts); err != nil {
+				return err
+			}
+			if err = restoreMetadata(header, path, opts); err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			// link target is kept as is, it's resolved inside the root when used
+			if err = os.Symlink(header.Linkname, path); err != nil {
+				return err
+			}
+			if err = restoreMetadata(header, path, opts); err != nil {
+				return err
+			}
+			continue
+
+		case tar.TypeLink:
+			if _, err = cleanEntryName(header.Linkname); err != nil {
+				return &UnsafePathError{Entry: header.Name, Reason: "hardlink target escapes target directory"}
+			}
+			target, err := securePath(targetDir, header.Linkname)
+			if err != nil {
+				return &UnsafePathError{Entry: header.Name, Reason: "hardlink target escapes target directory"}
+			}
+			// metadata is shared with the link target
+			if err = os.Link(target, path); err != nil {
+				return err
+			}
+			continue
+
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if err = extractDevice(header, path, opts); err != nil {
+				return err
+			}
+			// skipped devices have nothing to restore
+			if _, err = os.Lstat(path); err != nil {
+				continue
+			}
+			if err = restoreMetadata(header, path, opts); err != nil {
+				return err
+			}
+			continue
+
+		default:
+			// other entry types (e.g. GNU volume headers) have nothing to restore
+			continue
+		}
+	}
+
+	// deepest directories first, so that parent times are not modified afterwards
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path, err := securePath(targetDir, dirs[i].Name)
 		if err != nil {
 			return err
 		}
+		if err = restoreMetadata(dirs[i], path, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractFile writes a regular file contents
+// The file is closed, and synced if configured, before returning.
+func extractFile(r io.Reader, path string, buf []byte, opts *Options) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
 
+	// hide ReadFrom from io.CopyBuffer so that buf is actually used
+	if _, err = io.CopyBuffer(struct{ io.Writer }{file}, r, buf); err != nil {
+		file.Close()
+		return err
 	}
+
+	if opts.Fsync {
+		if err = file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// restoreMetadata applies ownership, permissions, extended attributes and times to an extracted entry
+// Ownership goes first since changing it clears setuid and setgid bits.
+func restoreMetadata(header *tar.Header, path string, opts *Options) error {
+
+	if opts.PreserveOwner {
+		if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+			return fmt.Errorf("Error restoring owner for %q: %s", header.Name, err.Error())
+		}
+	}
+
+	// symlinks permissions are meaningless
+	if header.Typeflag != tar.TypeSymlink {
+		mode := header.FileInfo().Mode()
+		perm := mode.Perm()
+		if opts.PreserveSpecialBits {
+			perm |= mode & (os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		}
+		if err := os.Chmod(path, perm); err != nil {
+			return err
+		}
+	}
+
+	if opts.PreserveXattrs || opts.PreserveCapabilities {
+		for key, value := range header.PAXRecords {
+			if !strings.HasPrefix(key, xattrPrefix) {
+				continue
+			}
+			attr := strings.TrimPrefix(key, xattrPrefix)
+			if (attr == capabilityXattr && !opts.PreserveCapabilities) || (attr != capabilityXattr && !opts.PreserveXattrs) {
+				continue
+			}
+			// linux only allows user attributes on regular files and directories
+			if header.Typeflag == tar.TypeSymlink && strings.HasPrefix(attr, "user.") {
+				continue
+			}
+			if err := unix.Lsetxattr(path, attr, []byte(value), 0); err != nil {
+				return fmt.Errorf("Error restoring extended attribute %q for %q: %s", attr, header.Name, err.Error())
+			}
+		}
+	}
+
+	if opts.PreserveTimes {
+		atime := header.AccessTime
+		if atime.IsZero() {
+			atime = header.ModTime
+		}
+		ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(header.ModTime.UnixNano())}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return fmt.Errorf("Error restoring times for %q: %s", header.Name, err.Error())
+		}
+	}
+
 	return nil
 }
+
+// extractDevice creates a device node or FIFO
+// Device nodes are only created when running privileged and allowed to, otherwise the fallback is applied
+func extractDevice(header *tar.Header, path string, opts *Options) error {
+	perm := uint32(header.Mode) & 07777
+
+	// FIFOs don't need privileges
+	if header.Typeflag == tar.TypeFifo {
+		return unix.Mkfifo(path, perm)
+	}
+
+	var err error
+	mode := header.FileInfo().Mode()
+	if opts.NoDevices {
+		err = deviceFallback(path, mode, opts.DeviceFallback)
+	} else {
+		err = MakeDevice(path, mode, uint32(header.Devmajor), uint32(header.Devminor), opts.DeviceFallback)
+	}
+	if err == errDeviceUnsupported {
+		return fmt.Errorf("Error extracting device %q: %s", header.Name, err.Error())
+	}
+	return err
+}
@@ -1,11 +1,59 @@
 package archive
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
+// testEntry is an entry to be written to a generated tarball
+type testEntry struct {
+	header tar.Header
+	body   string
+}
+
+// createTarball writes entries to a temporary tarball and returns its path
+func createTarball(t testing.TB, entries []testEntry) string {
+	f, err := ioutil.TempFile("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary tarball: %s", err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for _, e := range entries {
+		h := e.header
+		if h.Typeflag == tar.TypeReg || h.Typeflag == 0 {
+			h.Size = int64(len(e.body))
+		}
+		if h.Mode == 0 {
+			h.Mode = 0644
+		}
+		if err = tw.WriteHeader(&h); err != nil {
+			t.Fatalf("Couldn't write header for %q: %s", h.Name, err)
+		}
+		if _, err = tw.Write([]byte(e.body)); err != nil {
+			t.Fatalf("Couldn't write body for %q: %s", h.Name, err)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatalf("Couldn't close tarball: %s", err)
+	}
+	return f.Name()
+}
+
 func TestExtractTarBall(t *testing.T) {
 
 	var tarballData = []struct {
@@ -15,8 +63,12 @@ func TestExtractTarBall(t *testing.T) {
 		ExtractOK   bool   // whether the extraction command should succeed
 	}{
 		{"testdata/text.tar", "testdata/test1", "text", true},
-		{"testdata/text.tar.gz", "testdata/test2", "", false},
+		{"testdata/text.tar.gz", "testdata/test2", "text", true},
 		{"testdata/simple.tar", "testdata/test3", "loop-linux", true},
+		{"testdata/text.tar.bz2", "testdata/test4", "text", true},
+		{"testdata/text.tar.xz", "testdata/test5", "text", true},
+		{"testdata/text.tar.zst", "testdata/test6", "text", true},
+		{"testdata/nonexisting.tar", "testdata/test7", "", false},
 	}
 
 	for _, tb := range tarballData {
@@ -64,3 +116,466 @@ func TestExtractTarBall(t *testing.T) {
 
 	}
 }
+
+func TestExtractUnsafeEntries(t *testing.T) {
+
+	var testData = []struct {
+		entries []testEntry // tarball contents
+		refused string      // name of the entry expected to be refused
+	}{
+		{[]testEntry{{tar.Header{Name: "../../etc/cron.d/x"}, "pwned"}}, "../../etc/cron.d/x"},
+		{[]testEntry{{tar.Header{Name: "ok"}, "ok"}, {tar.Header{Name: "dir/../../x"}, "pwned"}}, "dir/../../x"},
+		{[]testEntry{{tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}, ""}}, "link"},
+	}
+
+	for _, td := range testData {
+
+		tarball := createTarball(t, td.entries)
+		defer os.Remove(tarball)
+
+		dir, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create test directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		err = ExtractTarball(tarball, dir)
+		if err == nil {
+			t.Errorf("Extraction of entry %q should have been refused, but was not", td.refused)
+			continue
+		}
+
+		upe, ok := err.(*UnsafePathError)
+		if !ok {
+			t.Errorf("Extraction of entry %q should fail with UnsafePathError, got %T: %s", td.refused, err, err)
+			continue
+		}
+		if upe.Entry != td.refused {
+			t.Errorf("Refused entry reported as %q but expected %q", upe.Entry, td.refused)
+		}
+	}
+}
+
+func TestExtractThroughExistingLinks(t *testing.T) {
+
+	var testData = []struct {
+		inPlace bool // whether the tarball is merged with the existing links or replaces them
+	}{
+		{false},
+		{true},
+	}
+
+	for _, td := range testData {
+
+		outside, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create outside directory: %s", err)
+		}
+		defer os.RemoveAll(outside)
+
+		dir, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create test directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		// a symlink pointing out of the root and a hardlink to a file out of the root
+		victim := filepath.Join(outside, "victim")
+		if err = ioutil.WriteFile(victim, []byte("untouched"), 0644); err != nil {
+			t.Fatalf("Couldn't create victim file: %s", err)
+		}
+		if err = os.Symlink(outside, filepath.Join(dir, "escape")); err != nil {
+			t.Fatalf("Couldn't create symlink: %s", err)
+		}
+		if err = os.Link(victim, filepath.Join(dir, "hardlink")); err != nil {
+			t.Fatalf("Couldn't create hardlink: %s", err)
+		}
+
+		tarball := createTarball(t, []testEntry{
+			{tar.Header{Name: "escape/victim"}, "pwned"},
+			{tar.Header{Name: "hardlink"}, "pwned"},
+		})
+		defer os.Remove(tarball)
+
+		opts := DefaultOptions()
+		opts.InPlace = td.inPlace
+		if err = ExtractTarballWithOptions(tarball, dir, opts); err != nil {
+			t.Fatalf("Error extracting tarball (in place %t): %s", td.inPlace, err)
+		}
+
+		content, err := ioutil.ReadFile(victim)
+		if err != nil {
+			t.Fatalf("Couldn't read victim file: %s", err)
+		}
+		if string(content) != "untouched" {
+			t.Errorf("File outside of the root was modified through an existing link (in place %t)", td.inPlace)
+		}
+
+		if td.inPlace {
+			// merged: the symlink is followed as if the root were "/"
+			confined := filepath.Join(dir, outside, "victim")
+			if _, err = os.Stat(confined); err != nil {
+				t.Errorf("Entry written through symlink was not confined to %q: %s", confined, err)
+			}
+			continue
+		}
+
+		// replaced: previous links are gone and entries are plain files
+		if fi, err := os.Lstat(filepath.Join(dir, "escape")); err != nil || !fi.IsDir() {
+			t.Errorf("Existing symlink was not replaced by the tarball directory: %v (%v)", fi, err)
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(dir, "escape/victim")); err != nil || string(content) != "pwned" {
+			t.Errorf("Replaced root escape/victim contains %q (%v)", content, err)
+		}
+	}
+}
+
+func TestExtractEntryTypes(t *testing.T) {
+
+	type entryTypesTest struct {
+		opts      Options     // extraction options
+		device    bool        // whether dev/null should exist after extraction
+		devType   os.FileMode // expected file type for dev/null
+		extractOK bool        // whether extraction should succeed
+	}
+
+	var testData = []entryTypesTest{
+		{Options{NoDevices: true, DeviceFallback: SkipDevice}, false, 0, true},
+		{Options{NoDevices: true, DeviceFallback: EmptyFileDevice}, true, 0, true},
+		{Options{NoDevices: true, DeviceFallback: FailDevice}, false, 0, false},
+	}
+
+	// creating actual device nodes depends on running privileged
+	if os.Geteuid() == 0 {
+		testData = append(testData, entryTypesTest{Options{}, true, os.ModeDevice | os.ModeCharDevice, true})
+	}
+
+	for _, td := range testData {
+
+		dir, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create test directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		err = ExtractTarballWithOptions("testdata/busybox.tar", dir, &td.opts)
+		if err != nil {
+			if td.extractOK {
+				t.Errorf("Error extracting busybox tarball with options %+v: %s", td.opts, err)
+			}
+			continue
+		}
+		if !td.extractOK {
+			t.Errorf("Extraction of busybox tarball with options %+v should have failed, but did not", td.opts)
+			continue
+		}
+
+		// symlinks are kept as symlinks
+		if target, err := os.Readlink(filepath.Join(dir, "bin/sh")); err != nil || target != "busybox" {
+			t.Errorf("Symlink bin/sh points to %q (%v) but expected %q", target, err, "busybox")
+		}
+
+		// hardlinks share the file
+		ls, err1 := os.Stat(filepath.Join(dir, "bin/ls"))
+		busybox, err2 := os.Stat(filepath.Join(dir, "bin/busybox"))
+		if err1 != nil || err2 != nil || !os.SameFile(ls, busybox) {
+			t.Errorf("Hardlink bin/ls is not the same file as bin/busybox")
+		}
+
+		// files written through a symlinked directory land in the link target
+		if _, err = os.Stat(filepath.Join(dir, "usr/lib/ld.so")); err != nil {
+			t.Errorf("File written through symlink lib was not found at usr/lib/ld.so: %s", err)
+		}
+
+		fifo, err := os.Lstat(filepath.Join(dir, "run/initctl"))
+		if err != nil || fifo.Mode()&os.ModeNamedPipe == 0 {
+			t.Errorf("FIFO run/initctl was not created (%v)", err)
+		}
+
+		null, err := os.Lstat(filepath.Join(dir, "dev/null"))
+		if err == nil && !td.device {
+			t.Errorf("Device dev/null should not exist with options %+v", td.opts)
+		} else if err != nil && td.device {
+			t.Errorf("Device dev/null was not created with options %+v: %s", td.opts, err)
+		} else if err == nil && null.Mode()&os.ModeType != td.devType {
+			t.Errorf("Device dev/null has type %v but expected %v", null.Mode()&os.ModeType, td.devType)
+		}
+	}
+}
+
+func TestExtractMetadata(t *testing.T) {
+
+	mtime := time.Date(2016, 5, 8, 9, 4, 0, 0, time.UTC)
+	tarball := createTarball(t, []testEntry{
+		{tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: mtime, Uid: 1234, Gid: 5678}, ""},
+		{tar.Header{Name: "dir/suid", Mode: 04755, ModTime: mtime, Uid: 1234, Gid: 5678,
+			PAXRecords: map[string]string{xattrPrefix + "user.fsisolate": "test"}}, "binary"},
+		{tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "suid", ModTime: mtime, Uid: 1234, Gid: 5678,
+			PAXRecords: map[string]string{xattrPrefix + "user.fsisolate": "link"}}, ""},
+	})
+	defer os.Remove(tarball)
+
+	// user attributes on symlinks are skipped, linux refuses them
+	var testData = []struct {
+		opts Options // extraction options
+	}{
+		{Options{}},
+		{Options{PreserveTimes: true, PreserveSpecialBits: true, PreserveXattrs: true}},
+	}
+
+	// restoring ownership requires privileges
+	if os.Geteuid() == 0 {
+		testData = append(testData, struct{ opts Options }{*DefaultOptions()})
+	}
+
+	for _, td := range testData {
+
+		dir, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create test directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err = ExtractTarballWithOptions(tarball, dir, &td.opts); err != nil {
+			t.Errorf("Error extracting tarball with options %+v: %s", td.opts, err)
+			continue
+		}
+
+		for _, name := range []string{"dir", "dir/suid", "dir/link"} {
+			fi, err := os.Lstat(filepath.Join(dir, name))
+			if err != nil {
+				t.Errorf("Couldn't stat extracted entry %q: %s", name, err)
+				continue
+			}
+
+			if fi.ModTime().Equal(mtime) != td.opts.PreserveTimes {
+				t.Errorf("Entry %q has modification time %s with options %+v", name, fi.ModTime(), td.opts)
+			}
+
+			st := fi.Sys().(*syscall.Stat_t)
+			if (st.Uid == 1234 && st.Gid == 5678) != td.opts.PreserveOwner {
+				t.Errorf("Entry %q is owned by %d:%d with options %+v", name, st.Uid, st.Gid, td.opts)
+			}
+		}
+
+		fi, err := os.Stat(filepath.Join(dir, "dir/suid"))
+		if err != nil {
+			t.Errorf("Couldn't stat extracted file: %s", err)
+			continue
+		}
+		if (fi.Mode()&os.ModeSetuid != 0) != td.opts.PreserveSpecialBits {
+			t.Errorf("File has mode %v with options %+v", fi.Mode(), td.opts)
+		}
+
+		value := make([]byte, 64)
+		n, err := unix.Getxattr(filepath.Join(dir, "dir/suid"), "user.fsisolate", value)
+		if td.opts.PreserveXattrs && (err != nil || string(value[:n]) != "test") {
+			t.Errorf("Extended attribute was not restored with options %+v: %v", td.opts, err)
+		} else if !td.opts.PreserveXattrs && err == nil {
+			t.Errorf("Extended attribute should not be restored with options %+v", td.opts)
+		}
+	}
+}
+
+func TestExtractAtomic(t *testing.T) {
+
+	parent, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create test directory: %s", err)
+	}
+	defer os.RemoveAll(parent)
+
+	root := filepath.Join(parent, "root")
+	if err = os.Mkdir(root, 0755); err != nil {
+		t.Fatalf("Couldn't create root directory: %s", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(root, "previous"), []byte("previous"), 0644); err != nil {
+		t.Fatalf("Couldn't create previous root contents: %s", err)
+	}
+
+	// truncated tarball: the second entry has less data than declared
+	complete := createTarball(t, []testEntry{
+		{tar.Header{Name: "first"}, "first"},
+		{tar.Header{Name: "second"}, strings.Repeat("x", 4096)},
+	})
+	defer os.Remove(complete)
+	content, err := ioutil.ReadFile(complete)
+	if err != nil {
+		t.Fatalf("Couldn't read generated tarball: %s", err)
+	}
+	truncated := complete + ".truncated"
+	if err = ioutil.WriteFile(truncated, content[:2048], 0644); err != nil {
+		t.Fatalf("Couldn't write truncated tarball: %s", err)
+	}
+	defer os.Remove(truncated)
+
+	if err = ExtractTarball(truncated, root); err == nil {
+		t.Fatalf("Extraction of truncated tarball should have failed, but did not")
+	}
+
+	// on failure the root is untouched and no staging is left behind
+	if _, err = os.Stat(filepath.Join(root, "first")); err == nil {
+		t.Errorf("Failed extraction left contents in the root")
+	}
+	if _, err = os.Stat(filepath.Join(root, "previous")); err != nil {
+		t.Errorf("Failed extraction modified previous root contents: %s", err)
+	}
+	if items, _ := ioutil.ReadDir(parent); len(items) != 1 {
+		t.Errorf("Failed extraction left %d items next to the root, expected only the root", len(items))
+	}
+
+	// on success the root contents are replaced
+	if err = ExtractTarball(complete, root); err != nil {
+		t.Fatalf("Error extracting tarball: %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "second")); err != nil {
+		t.Errorf("Extracted file not found in root: %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "previous")); err == nil {
+		t.Errorf("Previous root contents were not replaced")
+	}
+	if items, _ := ioutil.ReadDir(parent); len(items) != 1 {
+		t.Errorf("Extraction left %d items next to the root, expected only the root", len(items))
+	}
+}
+
+// manyFilesTarball generates a tarball with count small files spread over a few directories
+func manyFilesTarball(t testing.TB, count int) string {
+	entries := make([]testEntry, 0, count)
+	for i := 0; i < count; i++ {
+		entries = append(entries, testEntry{tar.Header{Name: fmt.Sprintf("dir%d/file%d", i%16, i)}, "small file contents\n"})
+	}
+	return createTarball(t, entries)
+}
+
+func TestExtractManyFiles(t *testing.T) {
+
+	tarball := manyFilesTarball(t, 2000)
+	defer os.Remove(tarball)
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create test directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// lower the descriptors limit well below the number of files
+	var limit syscall.Rlimit
+	if err = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatalf("Couldn't get descriptors limit: %s", err)
+	}
+	lowered := limit
+	lowered.Cur = 256
+	if err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered); err != nil {
+		t.Fatalf("Couldn't set descriptors limit: %s", err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+
+	for _, opts := range []Options{{}, {Fsync: true}} {
+		if err = ExtractTarballWithOptions(tarball, dir, &opts); err != nil {
+			t.Errorf("Error extracting tarball with many files and options %+v: %s", opts, err)
+		}
+	}
+}
+
+func BenchmarkExtractManyFiles(b *testing.B) {
+
+	tarball := manyFilesTarball(b, 10000)
+	defer os.Remove(tarball)
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		b.Fatalf("Couldn't create benchmark directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err = ExtractTarballWithOptions(tarball, dir, &Options{}); err != nil {
+			b.Fatalf("Error extracting tarball with many files: %s", err)
+		}
+	}
+}
+
+func TestExtractReader(t *testing.T) {
+
+	for _, file := range []string{"testdata/text.tar", "testdata/text.tar.gz", "testdata/text.tar.zst"} {
+
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Errorf("Couldn't read tarball %q: %s", file, err)
+			continue
+		}
+
+		dir, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create test directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		// in-memory tarball, read only once
+		r := bytes.NewReader(content)
+		if err = ExtractReader(r, dir, nil); err != nil {
+			t.Errorf("Error extracting in-memory tarball %q: %s", file, err)
+			continue
+		}
+
+		if r.Len() != 0 {
+			t.Errorf("Extraction of %q left %d bytes unread", file, r.Len())
+		}
+		if _, err = os.Stat(filepath.Join(dir, "text")); err != nil {
+			t.Errorf("Couldn't read file extracted from %q: %s", file, err)
+		}
+	}
+}
+
+// cancelReader cancels its context once the first block is read
+type cancelReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	if len(p) > 512 {
+		p = p[:512]
+	}
+	n, err := c.r.Read(p)
+	c.cancel()
+	return n, err
+}
+
+func TestExtractContext(t *testing.T) {
+
+	for _, file := range []string{"testdata/busybox.tar", "testdata/text.tar.gz", "testdata/busybox.zip"} {
+
+		dir, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create test directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err = ioutil.WriteFile(filepath.Join(dir, "keep"), []byte("previous contents"), 0644); err != nil {
+			t.Fatalf("Couldn't create file in test directory: %s", err)
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatalf("Couldn't open archive %q: %s", file, err)
+		}
+		defer f.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		err = ExtractContext(ctx, &cancelReader{r: f, cancel: cancel}, dir, nil)
+		if err != context.Canceled {
+			t.Errorf("Cancelled extraction of %q returned %v", file, err)
+		}
+
+		if _, err = os.Stat(filepath.Join(dir, "keep")); err != nil {
+			t.Errorf("Cancelled extraction of %q replaced target directory", file)
+		}
+		if staged, _ := filepath.Glob(filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".staging*")); len(staged) != 0 {
+			t.Errorf("Cancelled extraction of %q left staging directories %q", file, staged)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// sniffSize is the number of bytes read ahead to detect an archive format
+const sniffSize = 512
+
+// EntryReader iterates archive entries
+// Entries are described using tar headers, Read returns the current entry contents.
+// If an EntryReader also implements io.Closer it is closed after extraction.
+type EntryReader interface {
+	Next() (*tar.Header, error)
+	io.Reader
+}
+
+// Format is an archive format that can be extracted
+type Format struct {
+	Name  string                                 // format name
+	Match func(head []byte) bool                 // reports whether the head of a stream belongs to the format
+	Open  func(r io.Reader) (EntryReader, error) // returns the archive entries from a stream
+}
+
+// formats registered, in detection order
+var (
+	formatsMu sync.RWMutex
+	formats   []Format
+)
+
+func init() {
+	RegisterFormat(Format{Name: "tar", Match: matchTar, Open: openTar})
+	RegisterFormat(Format{Name: "zip", Match: matchZip, Open: openZip})
+	RegisterFormat(Format{Name: "cpio", Match: matchCpio, Open: openCpio})
+	RegisterFormat(Format{Name: "deb", Match: matchDeb, Open: openDeb})
+	RegisterFormat(Format{Name: "rpm", Match: matchRpm, Open: openRpm})
+}
+
+// RegisterFormat adds an archive format to the ones detected by Extract
+// Formats are matched in registration order.
+func RegisterFormat(f Format) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	formats = append(formats, f)
+}
+
+// DetectFormat returns the archive format matching the head of a stream
+// The reader is not advanced. Streams not matching any format are assumed to be tar,
+// since old tarballs don't have magic bytes.
+func DetectFormat(r *bufio.Reader) (Format, error) {
+	head, err := r.Peek(sniffSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return Format{}, err
+	}
+
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+
+	for _, f := range formats {
+		if f.Match(head) {
+			return f, nil
+		}
+	}
+	return Format{Name: "tar", Match: matchTar, Open: openTar}, nil
+}
+
+// ExtractFile extracts an archive file of any registered format to a target directory
+// A nil opts uses DefaultOptions
+func ExtractFile(archive string, targetDir string, opts *Options) error {
+	return ExtractFileContext(context.Background(), archive, targetDir, opts)
+}
+
+// ExtractFileContext extracts an archive file to a target directory until ctx is done
+// A nil opts uses DefaultOptions, see ExtractReaderContext for cancellation behavior.
+func ExtractFileContext(ctx context.Context, archive string, targetDir string, opts *Options) error {
+
+	// check that target directory exists
+	if _, err := os.Stat(targetDir); err != nil {
+		return err
+	}
+
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return ExtractContext(ctx, file, targetDir, opts)
+}
+
+// Extract extracts an archive stream of any registered format to a target directory
+// Compression and format are detected from the stream contents.
+// A nil opts uses DefaultOptions, see ExtractReader for staging behavior.
+func Extract(r io.Reader, targetDir string, opts *Options) error {
+	return ExtractContext(context.Background(), r, targetDir, opts)
+}
+
+// ExtractContext extracts an archive stream of any registered format until ctx is done
+// A nil opts uses DefaultOptions, see ExtractReaderContext for cancellation behavior.
+func ExtractContext(ctx context.Context, r io.Reader, targetDir string, opts *Options) error {
+
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+
+	// check that target directory exists
+	if _, err := os.Stat(targetDir); err != nil {
+		return err
+	}
+
+	cr := withContext(ctx, r)
+	dr, err := Decompress(cr)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer dr.Close()
+
+	br := bufio.NewReaderSize(dr, sniffSize)
+	format, err := DetectFormat(br)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("Error detecting archive format: %s", err.Error())
+	}
+
+	return extractStaged(ctx, targetDir, opts, func(dir string) error {
+		er, err := format.Open(br)
+		if err != nil {
+			return fmt.Errorf("Error opening %s archive: %s", format.Name, err.Error())
+		}
+		if c, ok := er.(io.Closer); ok {
+			defer c.Close()
+		}
+
+		if err = extractEntries(er, dir, opts); err != nil {
+			return err
+		}
+		// consume trailing data so that the whole stream is read, and verifying readers
+		// report mismatches before the target is replaced
+		if _, err = io.Copy(ioutil.Discard, br); err != nil {
+			return err
+		}
+		_, err = io.Copy(ioutil.Discard, cr)
+		return err
+	})
+}
+
+// matchTar detects POSIX and GNU tarballs
+func matchTar(head []byte) bool {
+	return len(head) >= 262 && bytes.Equal(head[257:262], []byte("ustar"))
+}
+
+// openTar returns the entries in a tarball
+func openTar(r io.Reader) (EntryReader, error) {
+	return tar.NewReader(r), nil
+}
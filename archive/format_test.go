@@ -0,0 +1,142 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+
+	var testData = []struct {
+		file   string // archive file to sniff
+		format string // expected format name
+	}{
+		{"testdata/busybox.tar", "tar"},
+		{"testdata/busybox.zip", "zip"},
+		{"testdata/busybox.cpio", "cpio"},
+		{"testdata/busybox.deb", "deb"},
+		{"testdata/busybox.rpm", "rpm"},
+		{"testdata/text.tar", "tar"},
+	}
+
+	for _, td := range testData {
+
+		f, err := os.Open(td.file)
+		if err != nil {
+			t.Errorf("Couldn't open file %q: %s", td.file, err)
+			continue
+		}
+		defer f.Close()
+
+		format, err := DetectFormat(bufio.NewReaderSize(f, sniffSize))
+		if err != nil {
+			t.Errorf("Error detecting format for %q: %s", td.file, err)
+			continue
+		}
+
+		if format.Name != td.format {
+			t.Errorf("Detected format for %q was %q but expected %q", td.file, format.Name, td.format)
+		}
+	}
+}
+
+func TestExtractFormats(t *testing.T) {
+
+	var testData = []struct {
+		file      string // archive file to extract
+		hardlinks bool   // whether the format keeps hardlinks
+	}{
+		{"testdata/busybox.tar", true},
+		{"testdata/busybox.zip", false},
+		{"testdata/busybox.cpio", true},
+		{"testdata/busybox.deb", true},
+		{"testdata/busybox.rpm", true},
+	}
+
+	for _, td := range testData {
+
+		dir, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create test directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err = ExtractFile(td.file, dir, nil); err != nil {
+			t.Errorf("Error extracting %q: %s", td.file, err)
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(dir, "bin/busybox"))
+		if err != nil || string(content) != "#!/bin/busybox\n" {
+			t.Errorf("File bin/busybox extracted from %q contains %q (%v)", td.file, content, err)
+		}
+
+		for link, target := range map[string]string{"bin/sh": "busybox", "lib": "usr/lib", "lib64": "/usr/lib"} {
+			if l, err := os.Readlink(filepath.Join(dir, link)); err != nil || l != target {
+				t.Errorf("Symlink %q extracted from %q points to %q (%v) but expected %q", link, td.file, l, err, target)
+			}
+		}
+
+		if td.hardlinks {
+			ls, err1 := os.Stat(filepath.Join(dir, "bin/ls"))
+			busybox, err2 := os.Stat(filepath.Join(dir, "bin/busybox"))
+			if err1 != nil || err2 != nil || !os.SameFile(ls, busybox) {
+				t.Errorf("Hardlink bin/ls extracted from %q is not the same file as bin/busybox", td.file)
+			}
+		}
+	}
+}
+
+// testFormatReader returns a single file entry whose contents follow the magic
+type testFormatReader struct {
+	r    io.Reader
+	done bool
+}
+
+func (f *testFormatReader) Next() (*tar.Header, error) {
+	if f.done {
+		return nil, io.EOF
+	}
+	f.done = true
+	return &tar.Header{Name: "registered", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len("contents"))}, nil
+}
+
+func (f *testFormatReader) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func TestRegisterFormat(t *testing.T) {
+
+	RegisterFormat(Format{
+		Name:  "test",
+		Match: func(head []byte) bool { return bytes.HasPrefix(head, []byte("FSISOLATE")) },
+		Open: func(r io.Reader) (EntryReader, error) {
+			if _, err := io.CopyN(ioutil.Discard, r, int64(len("FSISOLATE"))); err != nil {
+				return nil, err
+			}
+			return &testFormatReader{r: r}, nil
+		},
+	})
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create test directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = Extract(strings.NewReader("FSISOLATEcontents"), dir, nil); err != nil {
+		t.Fatalf("Error extracting registered format: %s", err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "registered"))
+	if err != nil || string(content) != "contents" {
+		t.Errorf("File extracted with registered format contains %q (%v)", content, err)
+	}
+}
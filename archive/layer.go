@@ -0,0 +1,117 @@
+package archive
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OCI whiteout entry names
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// ApplyLayer extracts an image layer stream over the contents of a target directory until ctx is done
+// OCI whiteouts in the layer remove existing entries: ".wh.<name>" removes name and
+// ".wh..wh..opq" removes every existing entry in its directory. Nothing is staged, so a
+// failed layer leaves the target directory partially modified.
+// A nil opts uses DefaultOptions.
+func ApplyLayer(ctx context.Context, r io.Reader, targetDir string, opts *Options) error {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	layerOpts := *opts
+	layerOpts.InPlace = true
+	layerOpts.Whiteouts = true
+	return ExtractContext(ctx, r, targetDir, &layerOpts)
+}
+
+// ApplyLayers extracts image layer files in order to a target directory until ctx is done
+// Layers are applied as with ApplyLayer. See ExtractLayers for staging behavior.
+func ApplyLayers(ctx context.Context, layers []string, targetDir string, opts *Options) error {
+	next := 0
+	return ExtractLayers(ctx, func() (io.ReadCloser, error) {
+		if next == len(layers) {
+			return nil, io.EOF
+		}
+		next++
+		return os.Open(layers[next-1])
+	}, targetDir, opts)
+}
+
+// ExtractLayers extracts image layer streams one over another to a target directory until ctx is done
+// next returns the streams in order and io.EOF after the last one, each stream is closed once extracted.
+// Layers are applied as with ApplyLayer. A nil opts uses DefaultOptions. Unless opts.InPlace is set
+// layers are extracted to a staging directory which replaces the target directory only if every
+// layer is extracted.
+func ExtractLayers(ctx context.Context, next func() (io.ReadCloser, error), targetDir string, opts *Options) error {
+
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+
+	// check that target directory exists
+	if _, err := os.Stat(targetDir); err != nil {
+		return err
+	}
+
+	return extractStaged(ctx, targetDir, opts, func(dir string) error {
+		for {
+			layer, err := next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			err = ApplyLayer(ctx, layer, dir, opts)
+			layer.Close()
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// applyWhiteout removes the entries hidden by a whiteout at path
+// Entries unpacked by the same layer are kept, whiteouts only apply to previous layers.
+func applyWhiteout(path string, unpacked map[string]bool) error {
+	dir, base := filepath.Split(path)
+	dir = filepath.Clean(dir)
+
+	if base != whiteoutOpaque {
+		name := strings.TrimPrefix(base, whiteoutPrefix)
+		if name == "" || name == "." || name == ".." {
+			return &UnsafePathError{Entry: path, Reason: "whiteout doesn't name an entry"}
+		}
+		target := filepath.Join(dir, name)
+		if unpacked[target] {
+			return nil
+		}
+		return os.RemoveAll(target)
+	}
+
+	// opaque directory, only this layer contents remain
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if p == dir || unpacked[p] {
+			return nil
+		}
+		if err = os.RemoveAll(p); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
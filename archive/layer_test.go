@@ -0,0 +1,114 @@
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyLayers(t *testing.T) {
+
+	base := createTarball(t, []testEntry{
+		{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg}, body: "base\n"},
+		{header: tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg}, body: "root:x:0:0::/root:/bin/sh\n"},
+		{header: tar.Header{Name: "var/cache/a", Typeflag: tar.TypeReg}, body: "a"},
+		{header: tar.Header{Name: "var/cache/sub/b", Typeflag: tar.TypeReg}, body: "b"},
+		{header: tar.Header{Name: "opt/keep", Typeflag: tar.TypeReg}, body: "keep"},
+		{header: tar.Header{Name: "usr/bin/tool", Typeflag: tar.TypeReg}, body: "tool"},
+	})
+	defer os.Remove(base)
+
+	whiteouts := createTarball(t, []testEntry{
+		{header: tar.Header{Name: "etc/.wh.hostname", Typeflag: tar.TypeReg}},
+		{header: tar.Header{Name: "var/cache/sub/c", Typeflag: tar.TypeReg}, body: "c"},
+		{header: tar.Header{Name: "var/cache/.wh..wh..opq", Typeflag: tar.TypeReg}},
+		{header: tar.Header{Name: "var/cache/new", Typeflag: tar.TypeReg}, body: "new"},
+		{header: tar.Header{Name: "opt/added", Typeflag: tar.TypeReg}, body: "added"},
+		{header: tar.Header{Name: "opt/.wh.added", Typeflag: tar.TypeReg}},
+	})
+	defer os.Remove(whiteouts)
+
+	top := createTarball(t, []testEntry{
+		{header: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg}, body: "layered\n"},
+		{header: tar.Header{Name: "usr/.wh.bin", Typeflag: tar.TypeReg}},
+	})
+	defer os.Remove(top)
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create test directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = ApplyLayers(context.Background(), []string{base, whiteouts, top}, dir, nil); err != nil {
+		t.Fatalf("Error applying layers: %s", err)
+	}
+
+	var testData = []struct {
+		path    string // path in the root
+		content string // expected contents, empty if it shouldn't exist
+	}{
+		{"etc/hostname", "layered\n"},
+		{"etc/passwd", "root:x:0:0::/root:/bin/sh\n"},
+		{"var/cache/a", ""},
+		{"var/cache/sub/b", ""},
+		{"var/cache/sub/c", "c"},
+		{"var/cache/new", "new"},
+		{"opt/keep", "keep"},
+		{"opt/added", "added"},
+		{"usr/bin", ""},
+	}
+
+	for _, td := range testData {
+		content, err := ioutil.ReadFile(filepath.Join(dir, td.path))
+		if td.content == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("Path %q should have been removed by a whiteout, but got %v", td.path, err)
+			}
+			continue
+		}
+		if err != nil || string(content) != td.content {
+			t.Errorf("Path %q contains %q (%v) but expected %q", td.path, content, err, td.content)
+		}
+	}
+
+	// whiteouts themselves are never extracted
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && strings.HasPrefix(fi.Name(), whiteoutPrefix) {
+			t.Errorf("Whiteout %q was extracted", path)
+		}
+		return nil
+	})
+}
+
+func TestApplyLayerUnsafeWhiteout(t *testing.T) {
+
+	layer := createTarball(t, []testEntry{
+		{header: tar.Header{Name: "etc/.wh..", Typeflag: tar.TypeReg}},
+	})
+	defer os.Remove(layer)
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create test directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := os.Open(layer)
+	if err != nil {
+		t.Fatalf("Couldn't open layer: %s", err)
+	}
+	defer f.Close()
+
+	if err = ApplyLayer(context.Background(), f, dir, nil); err == nil {
+		t.Errorf("Applying a whiteout without name should have failed, but did not")
+	}
+	if _, err = os.Stat(dir); err != nil {
+		t.Errorf("Target directory was removed by a whiteout: %s", err)
+	}
+}
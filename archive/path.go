@@ -0,0 +1,124 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks is the number of symlinks followed while resolving a path before giving up
+const maxSymlinks = 255
+
+// UnsafePathError is returned when an archive entry would be written outside the target directory
+type UnsafePathError struct {
+	Entry  string // entry name as found in the archive
+	Reason string // why the entry was refused
+}
+
+// Error implements the error interface
+func (e *UnsafePathError) Error() string {
+	return fmt.Sprintf("Refused archive entry %q: %s", e.Entry, e.Reason)
+}
+
+// cleanEntryName returns the entry name relative to the archive root
+// Leading slashes are stripped, names that escape the root using ".." are refused
+func cleanEntryName(name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(strings.TrimLeft(name, "/")))
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", &UnsafePathError{Entry: name, Reason: "path escapes target directory"}
+	}
+	if clean == "." {
+		return "", nil
+	}
+	return clean, nil
+}
+
+// securePath returns the path where an archive entry must be written under root
+// Parent directories are resolved following symlinks already present in root as if
+// root were "/", so that an entry can never be written outside of root.
+// The last element is never resolved, since it will be replaced by the entry.
+func securePath(root, name string) (string, error) {
+	clean, err := cleanEntryName(name)
+	if err != nil {
+		return "", err
+	}
+	if clean == "" {
+		return root, nil
+	}
+
+	dir, err := resolveInRoot(root, filepath.Dir(clean))
+	if err != nil {
+		return "", &UnsafePathError{Entry: name, Reason: err.Error()}
+	}
+	return filepath.Join(dir, filepath.Base(clean)), nil
+}
+
+// ResolvePath returns the path on the host of a path inside root
+// Symlinks are followed as if root were "/", so the result is always under root.
+func ResolvePath(root, path string) (string, error) {
+	return resolveInRoot(root, path)
+}
+
+// resolveInRoot resolves every symlink in path as if root were the filesystem root
+// Absolute symlinks are relative to root and ".." never goes above root.
+// Components that don't exist yet are joined as they are.
+func resolveInRoot(root, path string) (string, error) {
+	resolved := ""
+	remaining := filepath.ToSlash(path)
+	links := 0
+
+	for remaining != "" {
+		var part string
+		if i := strings.Index(remaining, "/"); i >= 0 {
+			part, remaining = remaining[:i], remaining[i+1:]
+		} else {
+			part, remaining = remaining, ""
+		}
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			// filepath.Dir returns "." at the top, which is root
+			resolved = filepath.Dir(resolved)
+			if resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links resolving %q", path)
+		}
+
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+
+		// absolute links start again from root, relative ones from the link's directory
+		if filepath.IsAbs(target) {
+			resolved = ""
+		}
+		remaining = filepath.ToSlash(target) + "/" + remaining
+	}
+
+	return filepath.Join(root, resolved), nil
+}
@@ -0,0 +1,75 @@
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecurePath(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create test root: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	// symlinks in place before extraction
+	links := map[string]string{
+		"abs":  "/usr/lib",
+		"rel":  "usr/lib",
+		"up":   "../../..",
+		"host": root,
+		"loop": "loop",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatalf("Couldn't create symlink %q: %s", name, err)
+		}
+	}
+
+	var testData = []struct {
+		name   string // entry name
+		path   string // expected path relative to root
+		pathOK bool   // whether the entry should be accepted
+	}{
+		{"file", "file", true},
+		{"./dir/file", "dir/file", true},
+		{"/etc/passwd", "etc/passwd", true},
+		{"dir/../file", "file", true},
+		{"../file", "", false},
+		{"../../etc/cron.d/x", "", false},
+		{"dir/../../file", "", false},
+		{"abs/libc.so", "usr/lib/libc.so", true},
+		{"rel/libc.so", "usr/lib/libc.so", true},
+		{"up/etc/cron.d/x", "etc/cron.d/x", true},
+		{"host/file", filepath.Join(root[1:], "file"), true},
+		{"abs", "abs", true},
+		{"loop/file", "", false},
+	}
+
+	for _, td := range testData {
+
+		p, err := securePath(root, td.name)
+		if err != nil {
+			if td.pathOK {
+				t.Errorf("Error securing path for entry %q: %s", td.name, err)
+				continue
+			}
+			if _, ok := err.(*UnsafePathError); !ok {
+				t.Errorf("Error securing path for entry %q should be an UnsafePathError, got %T", td.name, err)
+			}
+			continue
+		}
+
+		if !td.pathOK {
+			t.Errorf("Securing path for entry %q should have failed, but returned %q", td.name, p)
+			continue
+		}
+
+		if expected := filepath.Join(root, td.path); p != expected {
+			t.Errorf("Secured path for entry %q is %q but expected %q", td.name, p, expected)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// errExchangeUnsupported is returned where directories can't be exchanged atomically
+var errExchangeUnsupported = errors.New("atomic directory exchange not supported")
+
+// ReplaceDir fills a staging directory with fill and replaces the contents of targetDir with it on success
+// The target directory itself is kept, along with its owner, mode and extended attributes: the staging
+// directory gets them before fill runs, so fill can still change them. A symlinked target is resolved
+// and the directory it points to is replaced.
+// Where supported the staging directory is atomically exchanged with the target, so that the target
+// is never missing nor half replaced. Otherwise, as when the target is a mount point, entries are
+// moved one by one once fill succeeds.
+// The staging directory is removed on any error, leaving targetDir untouched.
+// Once ctx is done fill errors are reported as the context error and nothing is replaced.
+func ReplaceDir(ctx context.Context, targetDir string, fill func(dir string) error) error {
+	return replaceDir(ctx, targetDir, false, fill)
+}
+
+// replaceDir implements ReplaceDir, flushing the replacement to disk if fsync is set
+func replaceDir(ctx context.Context, targetDir string, fsync bool, fill func(dir string) error) error {
+
+	target, err := filepath.EvalSymlinks(targetDir)
+	if err != nil {
+		return err
+	}
+	// relative targets need an absolute parent to stage next to them
+	if target, err = filepath.Abs(target); err != nil {
+		return err
+	}
+	fi, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+
+	// staging must be on the same filesystem for renames, inside mount points
+	parent, base := filepath.Split(filepath.Clean(target))
+	mountPoint := IsMountPoint(target, parent)
+	stagingParent := parent
+	if mountPoint {
+		stagingParent = target
+	}
+	staging, err := ioutil.TempDir(stagingParent, "."+base+".staging")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	copyDirMetadata(target, staging, fi)
+
+	if err = fill(staging); err != nil {
+		return contextError(ctx, err)
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	// after the exchange staging holds the previous contents, removed when returning
+	exchanged := false
+	if !mountPoint {
+		err = exchange(staging, target)
+		if err != nil && err != errExchangeUnsupported {
+			return err
+		}
+		exchanged = err == nil
+	}
+	if !exchanged {
+		if err = swapContents(staging, target); err != nil {
+			return err
+		}
+	}
+
+	// make the replacement itself durable
+	if fsync {
+		if err = syncDir(target); err != nil {
+			return err
+		}
+		return syncDir(parent)
+	}
+	return nil
+}
+
+// swapContents moves the entries of staging into target, replacing its previous entries
+// Previous entries are moved to a directory inside target, removed once the swap is done.
+func swapContents(staging, target string) error {
+	trash, err := ioutil.TempDir(target, ".old")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(trash)
+
+	entries, err := ioutil.ReadDir(target)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := filepath.Join(target, e.Name())
+		if p == trash || p == staging {
+			continue
+		}
+		if err = os.Rename(p, filepath.Join(trash, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	if entries, err = ioutil.ReadDir(staging); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err = os.Rename(filepath.Join(staging, e.Name()), filepath.Join(target, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	// the target directory is kept, so is its metadata unless fill changed the staging one
+	if sfi, err := os.Stat(staging); err == nil {
+		copyDirMetadata(staging, target, sfi)
+	}
+	return nil
+}
+
+// copyDirMetadata copies owner, mode and extended attributes from one directory to another
+// Owner and attributes are copied as far as permitted.
+func copyDirMetadata(src, dst string, fi os.FileInfo) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		os.Lchown(dst, int(st.Uid), int(st.Gid))
+	}
+	os.Chmod(dst, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+	CopyXattrs(src, dst)
+}
+
+// IsMountPoint reports whether dir is on a different device than its parent
+func IsMountPoint(dir, parent string) bool {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return false
+	}
+	pfi, err := os.Stat(parent)
+	if err != nil {
+		return false
+	}
+	st, ok1 := fi.Sys().(*syscall.Stat_t)
+	pst, ok2 := pfi.Sys().(*syscall.Stat_t)
+	return ok1 && ok2 && st.Dev != pst.Dev
+}
@@ -0,0 +1,110 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplaceDir(t *testing.T) {
+
+	parent, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create test directory: %s", err)
+	}
+	defer os.RemoveAll(parent)
+
+	// a root with its own mode reached through a symlink
+	root := filepath.Join(parent, "root")
+	os.Mkdir(root, 0750)
+	os.Chmod(root, 0750)
+	ioutil.WriteFile(filepath.Join(root, "previous"), []byte("previous"), 0644)
+	link := filepath.Join(parent, "link")
+	if err = os.Symlink("root", link); err != nil {
+		t.Fatalf("Couldn't create symlink: %s", err)
+	}
+
+	var testData = []struct {
+		fillErr  error  // error returned by fill after writing a "replaced" file
+		expected string // expected only file in the root
+	}{
+		{errors.New("fill failed"), "previous"},
+		{nil, "replaced"},
+	}
+
+	for _, td := range testData {
+
+		err := ReplaceDir(context.Background(), link, func(dir string) error {
+			ioutil.WriteFile(filepath.Join(dir, "replaced"), []byte("replaced"), 0644)
+			return td.fillErr
+		})
+		if err != td.fillErr {
+			t.Errorf("Replacing directory returned %v but expected %v", err, td.fillErr)
+		}
+
+		entries, err := ioutil.ReadDir(root)
+		if err != nil || len(entries) != 1 || entries[0].Name() != td.expected {
+			t.Errorf("Root contains %v (%v) but expected only %q", entries, err, td.expected)
+		}
+		if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("Symlink to the root was replaced: %v (%v)", fi, err)
+		}
+		if fi, err := os.Stat(root); err != nil || fi.Mode().Perm() != 0750 {
+			t.Errorf("Root mode changed to %v (%v)", fi, err)
+		}
+		if items, _ := ioutil.ReadDir(parent); len(items) != 2 {
+			t.Errorf("Replacement left %d items next to the root, expected the root and its link", len(items))
+		}
+	}
+
+	// relative targets are staged next to them and synced with their parent
+	t.Chdir(parent)
+	err = replaceDir(context.Background(), "root", true, func(dir string) error {
+		if filepath.Dir(dir) != parent {
+			t.Errorf("Relative root staged at %q", dir)
+		}
+		return ioutil.WriteFile(filepath.Join(dir, "relative"), []byte("relative"), 0644)
+	})
+	if err != nil {
+		t.Errorf("Error replacing relative root: %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "relative")); err != nil {
+		t.Errorf("Relative root was not replaced: %s", err)
+	}
+}
+
+func TestSwapContents(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create test directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// staging inside the target, as done for mount points
+	target := filepath.Join(dir, "target")
+	os.MkdirAll(filepath.Join(target, "old/sub"), 0755)
+	ioutil.WriteFile(filepath.Join(target, "file"), []byte("old"), 0644)
+	staging := filepath.Join(target, ".staging")
+	os.MkdirAll(filepath.Join(staging, "new"), 0755)
+	ioutil.WriteFile(filepath.Join(staging, "file"), []byte("new"), 0644)
+
+	if err = swapContents(staging, target); err != nil {
+		t.Fatalf("Error swapping contents: %s", err)
+	}
+	os.RemoveAll(staging)
+
+	entries, err := ioutil.ReadDir(target)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Swapped target contains %v (%v)", entries, err)
+	}
+	if _, err = os.Stat(filepath.Join(target, "new")); err != nil {
+		t.Errorf("Staged directory was not moved: %s", err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(target, "file")); err != nil || string(content) != "new" {
+		t.Errorf("Swapped file contains %q (%v)", content, err)
+	}
+}
@@ -0,0 +1,84 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// rpm format constants
+const (
+	rpmLeadSize         = 96
+	rpmHeaderIntroSize  = 16
+	rpmHeaderIndexEntry = 16
+)
+
+var (
+	rpmLeadMagic   = []byte{0xed, 0xab, 0xee, 0xdb}
+	rpmHeaderMagic = []byte{0x8e, 0xad, 0xe8, 0x01}
+)
+
+// rpmReader returns the entries of a rpm package cpio payload
+type rpmReader struct {
+	EntryReader
+	payload io.ReadCloser
+}
+
+// matchRpm detects rpm packages
+func matchRpm(head []byte) bool {
+	return bytes.HasPrefix(head, rpmLeadMagic)
+}
+
+// openRpm skips the rpm lead, signature and header and returns the payload entries
+func openRpm(r io.Reader) (EntryReader, error) {
+
+	if _, err := io.CopyN(ioutil.Discard, r, rpmLeadSize); err != nil {
+		return nil, err
+	}
+
+	// signature header is aligned to 8 bytes, the main header is not
+	if err := skipRpmHeader(r, true); err != nil {
+		return nil, fmt.Errorf("invalid rpm signature: %s", err.Error())
+	}
+	if err := skipRpmHeader(r, false); err != nil {
+		return nil, fmt.Errorf("invalid rpm header: %s", err.Error())
+	}
+
+	// payload might be compressed with any supported algorithm
+	payload, err := Decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	cr, err := openCpio(payload)
+	if err != nil {
+		payload.Close()
+		return nil, err
+	}
+	return &rpmReader{EntryReader: cr, payload: payload}, nil
+}
+
+// skipRpmHeader reads past a rpm header structure
+func skipRpmHeader(r io.Reader, align bool) error {
+	intro := make([]byte, rpmHeaderIntroSize)
+	if _, err := io.ReadFull(r, intro); err != nil {
+		return err
+	}
+	if !bytes.Equal(intro[:4], rpmHeaderMagic) {
+		return fmt.Errorf("bad magic %x", intro[:4])
+	}
+
+	entries := int64(binary.BigEndian.Uint32(intro[8:12]))
+	size := int64(entries*rpmHeaderIndexEntry) + int64(binary.BigEndian.Uint32(intro[12:16]))
+	if align {
+		size += (8 - size%8) % 8
+	}
+	_, err := io.CopyN(ioutil.Discard, r, size)
+	return err
+}
+
+// Close releases the payload decompressor
+func (p *rpmReader) Close() error {
+	return p.payload.Close()
+}
@@ -0,0 +1,36 @@
+package archive
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+// CopyXattrs copies the extended attributes of a file to another, as far as permitted
+// Capabilities are kept as long as the owner of dst is not changed afterwards.
+func CopyXattrs(src, dst string) {
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil || size <= 0 {
+		return
+	}
+	list := make([]byte, size)
+	if size, err = unix.Llistxattr(src, list); err != nil {
+		return
+	}
+
+	for _, name := range bytes.Split(list[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		attr := string(name)
+		n, err := unix.Lgetxattr(src, attr, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, n)
+		if n, err = unix.Lgetxattr(src, attr, value); err != nil {
+			continue
+		}
+		unix.Lsetxattr(dst, attr, value[:n], 0)
+	}
+}
@@ -0,0 +1,108 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// zipReader returns the entries of a zip archive as tar headers
+// Zip archives need random access, so the stream is spooled to a temporary file.
+type zipReader struct {
+	spool   *os.File
+	zr      *zip.Reader
+	index   int
+	current io.ReadCloser
+}
+
+// matchZip detects zip archives, including empty ones
+func matchZip(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06"))
+}
+
+// openZip spools a zip stream and returns its entries
+func openZip(r io.Reader) (EntryReader, error) {
+	spool, err := ioutil.TempFile("", "fsisolate-zip")
+	if err != nil {
+		return nil, err
+	}
+
+	zr := &zipReader{spool: spool}
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		zr.Close()
+		return nil, err
+	}
+
+	zr.zr, err = zip.NewReader(spool, size)
+	if err != nil {
+		zr.Close()
+		return nil, err
+	}
+	return zr, nil
+}
+
+// Next advances to the next zip entry
+func (z *zipReader) Next() (*tar.Header, error) {
+	if z.current != nil {
+		z.current.Close()
+		z.current = nil
+	}
+
+	if z.index >= len(z.zr.File) {
+		return nil, io.EOF
+	}
+	f := z.zr.File[z.index]
+	z.index++
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	// symlink targets are stored as the entry contents, limited as cpio ones
+	var link string
+	fi := f.FileInfo()
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := ioutil.ReadAll(io.LimitReader(rc, cpioMaxPath+1))
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(target) > cpioMaxPath {
+			return nil, fmt.Errorf("zip symlink target for %q exceeds %d bytes", f.Name, cpioMaxPath)
+		}
+		link = string(target)
+	} else {
+		z.current = rc
+	}
+
+	header, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = f.Name
+	header.ModTime = f.Modified
+	return header, nil
+}
+
+// Read reads the current entry contents
+func (z *zipReader) Read(p []byte) (int, error) {
+	if z.current == nil {
+		return 0, io.EOF
+	}
+	return z.current.Read(p)
+}
+
+// Close removes the spooled archive
+func (z *zipReader) Close() error {
+	if z.current != nil {
+		z.current.Close()
+	}
+	z.spool.Close()
+	return os.Remove(z.spool.Name())
+}
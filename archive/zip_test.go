@@ -0,0 +1,57 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestZipLimits(t *testing.T) {
+
+	var testData = []struct {
+		target string // symlink target stored as entry contents
+		nextOK bool   // whether reading the entry should succeed
+	}{
+		{"target", true},
+		{strings.Repeat("x", cpioMaxPath), true},
+		{strings.Repeat("x", cpioMaxPath+1), false},
+	}
+
+	for i, td := range testData {
+
+		buf := &bytes.Buffer{}
+		zw := zip.NewWriter(buf)
+		fh := &zip.FileHeader{Name: "link"}
+		fh.SetMode(os.ModeSymlink | 0777)
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatalf("Couldn't create zip entry: %s", err)
+		}
+		w.Write([]byte(td.target))
+		zw.Close()
+
+		er, err := openZip(buf)
+		if err != nil {
+			t.Fatalf("Error opening zip archive: %s", err)
+		}
+
+		r := er.(*zipReader)
+		header, err := r.Next()
+		r.Close()
+		if err != nil {
+			if td.nextOK {
+				t.Errorf("Reading zip archive #%d returned an error: %s", i, err)
+			}
+			continue
+		}
+		if !td.nextOK {
+			t.Errorf("Reading zip archive #%d should have failed, but returned %+v", i, header)
+			continue
+		}
+		if header.Linkname != td.target {
+			t.Errorf("Zip archive #%d symlink points to %q", i, header.Linkname)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package fsisolate
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/odacremolbap/fsisolate/archive"
+	"github.com/odacremolbap/fsisolate/oci"
+)
+
+// defaultPath is the PATH of processes whose image doesn't set one
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// ExecConfig overrides the image configuration when starting a process with ExecImage
+// Empty fields keep the image defaults.
+type ExecConfig struct {
+	Entrypoint []string // replaces the image entrypoint, and its command unless Args is set
+	Args       []string // replaces the image command
+	Env        []string // "name=value" variables added to the image environment, replacing those with the same name
+	WorkingDir string   // directory inside the root to start at
+	User       string   // user as "name", "uid", "name:group" or "uid:gid", looked up in the root
+}
+
+// ExecImage executes the image entrypoint and command in chroot sandbox, killing it when ctx is done
+// The image configuration set with SetConfig provides the defaults, overridden by c, which can be nil.
+// Unlike Exec, the process gets the image environment only.
+func (p *ChrootedProcess) ExecImage(ctx context.Context, c *ExecConfig) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.getState() == Running {
+		return fmt.Errorf("Error starting process: there is another process executing in this chroot")
+	}
+
+	var image oci.ContainerConfig
+	if p.config != nil {
+		image = p.config.Config
+	}
+	if c == nil {
+		c = &ExecConfig{}
+	}
+
+	// as with containers, a new entrypoint drops the image command
+	var argv []string
+	switch {
+	case len(c.Entrypoint) > 0:
+		argv = append(append(argv, c.Entrypoint...), c.Args...)
+	case len(c.Args) > 0:
+		argv = append(append(argv, image.Entrypoint...), c.Args...)
+	default:
+		argv = append(append(argv, image.Entrypoint...), image.Cmd...)
+	}
+	if len(argv) == 0 {
+		return fmt.Errorf("Error starting process: no command in image config nor exec config")
+	}
+
+	env := mergeEnv(image.Env, c.Env)
+	if lookupEnv(env, "PATH") == "" {
+		env = append(env, "PATH="+defaultPath)
+	}
+
+	dir := firstNonEmpty(c.WorkingDir, image.WorkingDir, "/")
+	command, err := lookPathInRoot(p.root, dir, argv[0], lookupEnv(env, "PATH"))
+	if err != nil {
+		return fmt.Errorf("Error starting process: %s", err.Error())
+	}
+
+	cmd := &exec.Cmd{
+		Path:        command,
+		Args:        argv,
+		Env:         env,
+		Dir:         dir,
+		SysProcAttr: &syscall.SysProcAttr{Chroot: p.root},
+	}
+
+	if user := firstNonEmpty(c.User, image.User); user != "" {
+		if cmd.SysProcAttr.Credential, err = lookupUser(p.root, user); err != nil {
+			return fmt.Errorf("Error starting process: %s", err.Error())
+		}
+	}
+
+	return p.start(ctx, cmd)
+}
+
+// mergeEnv returns base environment with overrides replacing variables with the same name
+func mergeEnv(base, overrides []string) []string {
+	env := make([]string, 0, len(base)+len(overrides))
+	index := map[string]int{}
+	for _, v := range append(append([]string{}, base...), overrides...) {
+		name := strings.SplitN(v, "=", 2)[0]
+		if i, ok := index[name]; ok {
+			env[i] = v
+			continue
+		}
+		index[name] = len(env)
+		env = append(env, v)
+	}
+	return env
+}
+
+// lookupEnv returns the value of a variable in env, empty if not set
+func lookupEnv(env []string, name string) string {
+	for _, v := range env {
+		if strings.HasPrefix(v, name+"=") {
+			return v[len(name)+1:]
+		}
+	}
+	return ""
+}
+
+// firstNonEmpty returns the first non empty value
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// lookPathInRoot returns the path inside root of an executable
+// Names with a slash are relative to dir, others are searched in the PATH directories.
+func lookPathInRoot(root, dir, file, pathEnv string) (string, error) {
+	var candidates []string
+	if strings.Contains(file, "/") {
+		candidates = []string{path.Join(dir, file)}
+	} else {
+		for _, d := range strings.Split(pathEnv, ":") {
+			if d == "" {
+				d = dir
+			}
+			candidates = append(candidates, path.Join(d, file))
+		}
+	}
+
+	for _, candidate := range candidates {
+		host, err := archive.ResolvePath(root, candidate)
+		if err != nil {
+			continue
+		}
+		if fi, err := os.Stat(host); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("executable %q not found in root %q", file, root)
+}
+
+// lookupUser returns the credentials for a user spec, looking up names in the root databases
+// Without group, the user primary group is used, or 0 if the user is not in the database.
+func lookupUser(root, spec string) (*syscall.Credential, error) {
+	userSpec, groupSpec := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		userSpec, groupSpec = spec[:i], spec[i+1:]
+	}
+
+	cred := &syscall.Credential{}
+
+	// passwd entries are name:password:uid:gid:...
+	if uid, err := strconv.ParseUint(userSpec, 10, 32); err == nil {
+		cred.Uid = uint32(uid)
+		if entry, err := lookupDatabase(root, "/etc/passwd", userSpec, 2); err == nil && entry != nil {
+			cred.Gid, _ = parseID(entry[3])
+		}
+	} else {
+		entry, err := lookupDatabase(root, "/etc/passwd", userSpec, 0)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			return nil, fmt.Errorf("user %q not found in root %q", userSpec, root)
+		}
+		if cred.Uid, err = parseID(entry[2]); err != nil {
+			return nil, err
+		}
+		if cred.Gid, err = parseID(entry[3]); err != nil {
+			return nil, err
+		}
+	}
+
+	if groupSpec == "" {
+		return cred, nil
+	}
+
+	// group entries are name:password:gid:members
+	if gid, err := strconv.ParseUint(groupSpec, 10, 32); err == nil {
+		cred.Gid = uint32(gid)
+		return cred, nil
+	}
+	entry, err := lookupDatabase(root, "/etc/group", groupSpec, 0)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("group %q not found in root %q", groupSpec, root)
+	}
+	if cred.Gid, err = parseID(entry[2]); err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+// lookupDatabase returns the fields of the first entry in a colon separated database
+// whose field at index equals value, nil if there's none
+func lookupDatabase(root, database, value string, index int) ([]string, error) {
+	host, err := archive.ResolvePath(root, database)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(host)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) > 3 && fields[index] == value {
+			return fields, nil
+		}
+	}
+	return nil, scanner.Err()
+}
+
+// parseID parses a numeric user or group id
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q: %s", s, err.Error())
+	}
+	return uint32(id), nil
+}
@@ -0,0 +1,147 @@
+package fsisolate
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/odacremolbap/fsisolate/archive"
+	"golang.org/x/sys/unix"
+)
+
+// copyFunc copies a regular file from src to a new file at dst
+type copyFunc func(src, dst string, mode os.FileMode) error
+
+// copyTree copies the directory src to dst keeping modes, times, symlinks, hardlinks, devices and fifos
+// Regular files are copied with file. Owners and extended attributes are kept when permitted.
+// Device nodes that can't be created, as when unprivileged, are skipped like extraction does
+// by default. Sockets are not copied.
+func copyTree(src, dst string, file copyFunc) error {
+	links := map[uint64]string{}
+	var dirs []string
+
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			if err = os.MkdirAll(target, fi.Mode().Perm()|0700); err != nil {
+				return err
+			}
+			// directory modes and times are set once their contents are copied
+			dirs = append(dirs, rel)
+			return nil
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err = os.Symlink(link, target); err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+				if first, ok := links[uint64(st.Ino)]; ok {
+					return os.Link(first, target)
+				}
+				links[uint64(st.Ino)] = target
+			}
+			if err = file(path, target, fi.Mode()); err != nil {
+				return err
+			}
+		case fi.Mode()&os.ModeNamedPipe != 0:
+			if err = unix.Mkfifo(target, uint32(fi.Mode().Perm())); err != nil {
+				return err
+			}
+		case fi.Mode()&os.ModeDevice != 0:
+			var rdev uint64
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+				rdev = uint64(st.Rdev)
+			}
+			if err = archive.MakeDevice(target, fi.Mode(), unix.Major(rdev), unix.Minor(rdev), archive.SkipDevice); err != nil {
+				return err
+			}
+			// skipped when they can't be created
+			if _, err = os.Lstat(target); err != nil {
+				return nil
+			}
+		default:
+			return nil
+		}
+
+		return copyMetadata(path, target, fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fi, err := os.Lstat(filepath.Join(src, dirs[i]))
+		if err != nil {
+			return err
+		}
+		if err = copyMetadata(filepath.Join(src, dirs[i]), filepath.Join(dst, dirs[i]), fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the contents of a regular file, sharing them with a reflink when the filesystem supports it
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if err = reflink(out, in); err != nil {
+		if _, err = io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// linkFile hardlinks a regular file, copying it when src and dst are on different filesystems
+func linkFile(src, dst string, mode os.FileMode) error {
+	err := os.Link(src, dst)
+	if le, ok := err.(*os.LinkError); ok && le.Err == syscall.EXDEV {
+		return copyFile(src, dst, mode)
+	}
+	return err
+}
+
+// copyMetadata copies owner, extended attributes, mode and times of src to a copied file
+// Owners and extended attributes are only changed when permitted.
+func copyMetadata(src, path string, fi os.FileInfo) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		os.Lchown(path, int(st.Uid), int(st.Gid))
+	}
+	// set after the owner, whose change drops file capabilities
+	archive.CopyXattrs(src, path)
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	// mode is set after the owner, whose change drops setuid and setgid bits,
+	// and after creation, which is subject to the umask
+	mode := fi.Mode()&os.ModePerm | fi.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(path, fi.ModTime(), fi.ModTime())
+}
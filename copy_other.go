@@ -0,0 +1,13 @@
+//go:build !linux
+
+package fsisolate
+
+import (
+	"fmt"
+	"os"
+)
+
+// reflink fails, reflinks are only made on linux
+func reflink(dst, src *os.File) error {
+	return fmt.Errorf("reflinks are not supported on this platform")
+}
@@ -0,0 +1,25 @@
+package fsisolate
+
+import (
+	"fmt"
+
+	"github.com/odacremolbap/fsisolate/archive"
+)
+
+// DiffImage returns the paths changed in root since it was prepared from an image
+// The image can be a directory or an archive file, see archive.Changes for what is reported.
+// The changes can be written as an image layer with archive.CreateLayer.
+func DiffImage(imagePath, root string) ([]archive.Change, error) {
+	ptype, err := getPathType(imagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch ptype {
+	case directoryPath:
+		return archive.Changes(imagePath, root)
+	case filePath:
+		return archive.ArchiveChanges(imagePath, root, nil)
+	}
+	return nil, fmt.Errorf("Cannot diff image: image %q is not a directory nor an archive file", imagePath)
+}
@@ -0,0 +1,78 @@
+package fsisolate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/odacremolbap/fsisolate/archive"
+)
+
+func TestDiffImage(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "image")
+	lowerImage(t, image)
+	tarball := filepath.Join(dir, "image.tar")
+	if err = archive.CreateTarball(image, tarball, nil); err != nil {
+		t.Fatalf("Couldn't create image tarball: %s", err)
+	}
+
+	var testData = []struct {
+		image  string // image the root is prepared from
+		diffOK bool   // whether diff should succeed
+	}{
+		{image, true},
+		{tarball, true},
+		{"http://test.url/image.tar", false},
+	}
+
+	for _, td := range testData {
+
+		root := filepath.Join(dir, "root")
+		os.RemoveAll(root)
+		os.Mkdir(root, 0755)
+		if err = archive.ExtractTarball(tarball, root); err != nil {
+			t.Fatalf("Couldn't prepare root: %s", err)
+		}
+
+		// a job changing the root
+		ioutil.WriteFile(filepath.Join(root, "etc/hostname"), []byte("job\n"), 0644)
+		os.Chmod(filepath.Join(root, "etc/motd"), 0644)
+		os.RemoveAll(filepath.Join(root, "bin"))
+
+		changes, err := DiffImage(td.image, root)
+		if err != nil {
+			if td.diffOK {
+				t.Errorf("Diff of %q returned an error: %s", td.image, err)
+			}
+			continue
+		}
+		if !td.diffOK {
+			t.Errorf("Diff of %q should have failed, but did not", td.image)
+			continue
+		}
+
+		expected := []archive.Change{
+			{Path: "/bin", Kind: archive.ChangeDeleted},
+			{Path: "/etc/hostname", Kind: archive.ChangeModified, Contents: true},
+			{Path: "/etc/motd", Kind: archive.ChangeModified, Mode: true},
+		}
+		if len(changes) != len(expected) {
+			t.Errorf("Diff of %q is %+v but expected %+v", td.image, changes, expected)
+			continue
+		}
+		for i := range expected {
+			if changes[i] != expected[i] {
+				t.Errorf("Diff of %q is %+v but expected %+v", td.image, changes, expected)
+				break
+			}
+		}
+	}
+}
@@ -1,14 +1,21 @@
 package fsisolate
 
+import "context"
+
 // Prepare prepares the filesystem structure to start a chrooted execution
 func Prepare(imagePath string, root string) (*ChrootedProcess, error) {
+	return PrepareContext(context.Background(), imagePath, root)
+}
+
+// PrepareContext prepares the filesystem structure to start a chrooted execution until ctx is done
+func PrepareContext(ctx context.Context, imagePath string, root string) (*ChrootedProcess, error) {
 
 	// use default values
 	img := Image{}
 
 	// prepare, download if URL
 	// root returns the new root where the image is going to be executed
-	realRoot, err := img.Prepare(imagePath, root)
+	realRoot, config, err := img.PrepareConfig(ctx, imagePath, root)
 	if err != nil {
 		return nil, err
 	}
@@ -19,6 +26,8 @@ func Prepare(imagePath string, root string) (*ChrootedProcess, error) {
 	// 	return nil, err
 	// }
 
-	// create the chroot process structure
-	return NewChrootProcess(realRoot), nil
+	// create the chroot process structure, with the image defaults if known
+	p := NewChrootProcess(realRoot)
+	p.SetConfig(config)
+	return p, nil
 }
@@ -0,0 +1,10 @@
+module github.com/odacremolbap/fsisolate
+
+go 1.26.0
+
+require (
+	github.com/klauspost/compress v1.20.1
+	github.com/ulikunitz/xz v0.5.17
+	golang.org/x/crypto v0.57.0
+	golang.org/x/sys v0.48.0
+)
@@ -1,74 +1,392 @@
 package fsisolate
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 
 	"github.com/odacremolbap/fsisolate/archive"
 	"github.com/odacremolbap/fsisolate/net"
+	"github.com/odacremolbap/fsisolate/oci"
+	"github.com/odacremolbap/fsisolate/store"
+	"github.com/odacremolbap/fsisolate/verify"
 )
 
+// signatureSuffix is appended to the image path to look for its detached signature
+const signatureSuffix = ".minisig"
+
 // Image manages isolation images
 type Image struct {
-	Client *http.Client // http configured client to download image in case path type is URLImage
+	Client           *http.Client        // http configured client to download image in case path type is URLImage
+	Digest           string              // expected archive digest as "sha256:<hex>" or "sha512:<hex>", URLs can also carry it as a "#sha256=<hex>" fragment
+	Signature        string              // path or URL to the image minisign signature, defaults to the image path plus ".minisig"
+	TrustedKeys      []verify.PublicKey  // keys trusted to sign images, signatures are only checked when set
+	RequireSignature bool                // refuse images without a valid signature from a trusted key
+	Store            *store.Store        // cache for downloaded images, nil to download on every prepare
+	Retry            *net.RetryPolicy    // retries requests opening image downloads, nil to fail on first error, see net.RetryPolicy
+	Progress         net.ProgressFunc    // observes image downloads progress, nil for none
+	Redirect         *net.RedirectPolicy // redirections followed, nil for the client policy
+	CopyOnWrite      bool                // directory images are handed out as an overlay at root instead of the directory itself
 }
 
 // Prepare prepares the directory to isolate with chroot
-// path: the path to the image. can be directory, local tarball file or URL to tarball
+// path: the path to the image. can be directory, local archive file or URL to archive
+// archives can be tarballs, zip, cpio, deb or rpm packages, detected by contents
 // root: directory where the new root will be placed. Non used if Image.path is a directory
-// If path is a URL the image will get downloaded to a temporary directory and extracted to root
+// If path is a URL the image will get downloaded and extracted to root in a single pass
+// If the image has a store, downloads are kept there and reused while not modified
 // If path is a tarball file it will be extracted to root
+// Extracted images replace root contents only when extraction succeeds
+// If a digest is expected it is verified while extracting, a mismatch fails before root is replaced
+// Signatures are verified the same way when trusted keys are configured
 // If path is a directory that directory will be the new root. Image.Root value won't be used
+// unless the image is copy on write, then the new root is an overlay of the directory at root,
+// which can be discarded or captured afterwards with Overlay{Dir: root}
+// Paths with a registered source scheme, such as file://, oci-layout: or docker-archive:,
+// are resolved to a local path or to layers extracted one over another honoring OCI whiteouts.
+// Existing local files and directories are never taken for source references
 func (i *Image) Prepare(path, root string) (string, error) {
+	return i.PrepareContext(context.Background(), path, root)
+}
+
+// PrepareContext prepares the directory to isolate with chroot until ctx is done
+// Cancelling ctx aborts downloads and extraction, returning the context error.
+// As with any other error, root is not replaced.
+func (i *Image) PrepareContext(ctx context.Context, path, root string) (string, error) {
+	root, _, err := i.PrepareConfig(ctx, path, root)
+	return root, err
+}
+
+// PrepareConfig prepares the directory to isolate with chroot and returns the image configuration
+// Only images from sources that know their configuration have one, it's nil otherwise.
+// With a store, the configuration is kept there for the image path.
+func (i *Image) PrepareConfig(ctx context.Context, path, root string) (string, *oci.ImageConfig, error) {
 
 	ptype, err := getPathType(path)
 
+	// registered sources point to a local path or to layers to extract
+	if ptype == sourcePath {
+		var img *ResolvedImage
+		if img, err = resolveSource(ctx, path); err != nil {
+			return "", nil, err
+		}
+		if img.Path == "" {
+			if root, err = i.prepareLayers(ctx, path, img.Layers, root); err != nil {
+				return "", nil, err
+			}
+			if i.Store != nil && img.Config != nil {
+				if err = i.Store.SaveConfig(path, img.Config); err != nil {
+					return "", nil, err
+				}
+			}
+			return root, img.Config, nil
+		}
+		// resolved paths are local paths or URLs, never other sources
+		path = img.Path
+		if ptype, err = getPathType(path); ptype == sourcePath {
+			ptype = unknownPath
+		}
+	}
+
 	// if it's an URL, download the file to a local folder
 	if ptype == unknownPath || err != nil {
-		return "", fmt.Errorf("Cannot prepare image: image path format unknown")
+		return "", nil, fmt.Errorf("Cannot prepare image: image path format unknown")
+	}
+
+	root, err = i.prepareArchive(ctx, path, ptype, root)
+	return root, nil, err
+}
+
+// prepareArchive prepares the directory from a directory, archive file or URL
+func (i *Image) prepareArchive(ctx context.Context, path string, ptype pathType, root string) (string, error) {
+
+	digest, err := i.expectedDigest(path, ptype)
+	if err != nil {
+		return "", err
 	}
 
 	// if it's a directory discard root value and use the image's directory
 	if ptype == directoryPath {
+		if digest != nil || i.RequireSignature {
+			return "", fmt.Errorf("Cannot prepare image: directory %q can't be verified", path)
+		}
+		if i.CopyOnWrite {
+			o, err := NewOverlay(path, root)
+			if err != nil {
+				return "", err
+			}
+			return o.Root(), nil
+		}
 		return path, nil
 	}
 
-	// real local image file.
-	var localFilePath string
+	signature, err := i.signature(ctx, path, ptype)
+	if err != nil {
+		return "", err
+	}
+
+	os.Mkdir(root, 0777)
+
+	var image io.Reader
+
+	// archive being stored while extracted, and where it comes from
+	var blob *store.Writer
+	var source *store.Source
 
-	// if it's an URL, download the file to a local temp folder
-	// TODO is currently out of the scope: image cache management.
-	// For now download the tarball into a temp dir, extract to root, and delete.
+	// if it's an URL, stream the download straight into extraction
 	if ptype == urlPath {
+		var body io.ReadCloser
+		if body, err = i.openStored(digest); err != nil {
+			return "", err
+		}
+		if body != nil {
+			// stored archives are named by the digest computed when they were stored
+			digest = nil
+		} else if body, blob, source, err = i.openURL(ctx, path); err != nil {
+			return "", err
+		}
+		defer body.Close()
+		image = body
 
-		// generate temp dir
-		var downloadDir string
-		downloadDir, err = ioutil.TempDir("", "fsisolate")
+		if blob != nil {
+			image = io.TeeReader(image, blob)
+		}
+	} else {
+		// if it's a file read it
+		file, err := os.Open(path)
 		if err != nil {
 			return "", err
 		}
+		defer file.Close()
+		image = file
+	}
 
-		// download image to temp dir
-		r := net.Resource{
-			Client: i.Client,
+	// verify while streaming, extraction reads the whole stream and fails before root is replaced on mismatch
+	if digest != nil {
+		if image, err = verify.NewReader(image, *digest); err != nil {
+			return "", err
 		}
-		localFilePath, err = r.Download(path, downloadDir)
-		if err != nil {
+	}
+	if signature != nil {
+		if image, err = verify.NewSignatureReader(image, signature, i.TrustedKeys); err != nil {
 			return "", err
 		}
-	} else {
-		// if it's a file assign to local file var
-		localFilePath = path
+	}
+
+	if err = archive.ExtractContext(ctx, image, root, nil); err != nil {
+		if blob != nil {
+			blob.Abort()
+		}
+		return "", err
+	}
+
+	// extraction read the whole archive, which has been verified
+	if blob != nil {
+		if _, err = blob.Commit(source); err != nil {
+			return "", err
+		}
+	}
+	return root, nil
+
+}
+
+// prepareLayers extracts the layers of an image one over another to root
+// Layers are verified by their source, image digest and signature don't apply to them.
+func (i *Image) prepareLayers(ctx context.Context, path string, layers []Layer, root string) (string, error) {
+	if i.Digest != "" || i.RequireSignature {
+		return "", fmt.Errorf("Cannot prepare image: layered image %q can't be verified with an image digest or signature", path)
 	}
 
 	os.Mkdir(root, 0777)
 
-	err = archive.ExtractTarball(localFilePath, root)
+	next := 0
+	err := archive.ExtractLayers(ctx, func() (io.ReadCloser, error) {
+		if next == len(layers) {
+			return nil, io.EOF
+		}
+		layer := layers[next]
+		next++
+
+		r, err := layer.Open(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot prepare image: error opening layer %s: %s", layer.Name, err.Error())
+		}
+		return r, nil
+	}, root, nil)
 	if err != nil {
 		return "", err
 	}
 	return root, nil
+}
 
+// openStored returns the stored archive named by the expected digest, nil if it is not stored
+// Stored archives are opened locked so they're not collected while extracted,
+// an archive collected before being opened is just not stored.
+func (i *Image) openStored(digest *verify.Digest) (io.ReadCloser, error) {
+	if i.Store == nil || digest == nil {
+		return nil, nil
+	}
+	file, err := i.Store.Open(*digest)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// openURL returns the image stream for a URL
+// With a store, a stored archive is used when the remote site reports it as not modified.
+// Otherwise a writer to store the download is returned along with its source.
+func (i *Image) openURL(ctx context.Context, path string) (io.ReadCloser, *store.Writer, *store.Source, error) {
+	r := net.Resource{
+		Client:   i.Client,
+		Retry:    i.Retry,
+		Progress: i.Progress,
+		Redirect: i.Redirect,
+	}
+
+	if i.Store == nil {
+		body, err := r.OpenContext(ctx, path)
+		return body, nil, nil, err
+	}
+
+	// sources are recorded without fragment
+	key := path
+	if u, err := url.Parse(path); err == nil {
+		u.Fragment = ""
+		key = u.String()
+	}
+
+	src, err := i.Store.Source(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var validators net.Validators
+	if src != nil {
+		validators = net.Validators{ETag: src.ETag, LastModified: src.LastModified}
+	}
+
+	body, validators, err := r.OpenIfModifiedContext(ctx, path, validators)
+	if err == net.ErrNotModified {
+		var d verify.Digest
+		if d, err = verify.ParseDigest(src.Digest); err != nil {
+			return nil, nil, nil, err
+		}
+		var file *os.File
+		if file, err = i.Store.Open(d); !os.IsNotExist(err) {
+			return file, nil, nil, err
+		}
+		// collected since the source was looked up, download it again
+		body, validators, err = r.OpenIfModifiedContext(ctx, path, net.Validators{})
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	blob, err := i.Store.Create()
+	if err != nil {
+		body.Close()
+		return nil, nil, nil, err
+	}
+	return body, blob, &store.Source{URL: key, ETag: validators.ETag, LastModified: validators.LastModified}, nil
+}
+
+// expectedDigest returns the digest the image must match, nil if none
+// The digest can be set at the Image or as a URL fragment, but both must agree.
+func (i *Image) expectedDigest(path string, ptype pathType) (*verify.Digest, error) {
+	var digest *verify.Digest
+
+	if i.Digest != "" {
+		d, err := verify.ParseDigest(i.Digest)
+		if err != nil {
+			return nil, err
+		}
+		digest = &d
+	}
+
+	if ptype != urlPath {
+		return digest, nil
+	}
+
+	u, err := url.Parse(path)
+	if err != nil || u.Fragment == "" {
+		return digest, err
+	}
+	d, err := verify.ParseDigest(u.Fragment)
+	if err != nil {
+		return nil, err
+	}
+	if digest != nil && *digest != d {
+		return nil, fmt.Errorf("Cannot prepare image: URL digest %s doesn't match image digest %s", d, digest)
+	}
+	return &d, nil
+}
+
+// signature returns the image detached signature, nil if it doesn't have to be verified
+// Unless signatures are required, a missing signature at the default location is not an error.
+func (i *Image) signature(ctx context.Context, path string, ptype pathType) (*verify.Signature, error) {
+
+	if len(i.TrustedKeys) == 0 {
+		if i.RequireSignature {
+			return nil, fmt.Errorf("Cannot prepare image: signature required but no trusted keys configured")
+		}
+		return nil, nil
+	}
+
+	sigPath := i.Signature
+	if sigPath == "" {
+		// URL fragments don't belong to the image file name
+		if ptype == urlPath {
+			if u, err := url.Parse(path); err == nil {
+				u.Fragment = ""
+				path = u.String()
+			}
+		}
+		sigPath = path + signatureSuffix
+	}
+
+	data, err := i.readSignature(ctx, sigPath)
+	if err != nil {
+		// a default signature that is not found is only an error if required
+		if i.Signature == "" && !i.RequireSignature && isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Cannot prepare image: error reading signature %q: %s", sigPath, err.Error())
+	}
+
+	return verify.ParseSignature(data)
+}
+
+// readSignature reads a signature from a local file or URL
+func (i *Image) readSignature(ctx context.Context, sigPath string) ([]byte, error) {
+	u, err := url.Parse(sigPath)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ioutil.ReadFile(sigPath)
+	}
+
+	r := net.Resource{
+		Client:   i.Client,
+		Retry:    i.Retry,
+		Redirect: i.Redirect,
+	}
+	body, err := r.OpenContext(ctx, sigPath)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// isNotFound reports whether an error means a file or remote resource doesn't exist
+func isNotFound(err error) bool {
+	if se, ok := err.(*net.StatusError); ok {
+		return se.StatusCode == http.StatusNotFound
+	}
+	return os.IsNotExist(err)
 }
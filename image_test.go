@@ -1,12 +1,27 @@
 package fsisolate
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/odacremolbap/fsisolate/oci"
+	"github.com/odacremolbap/fsisolate/store"
+	"github.com/odacremolbap/fsisolate/verify"
+	"golang.org/x/crypto/blake2b"
 )
 
 // mockedResource returns a mocked web server and a client that redirects all request to the server
@@ -47,6 +62,10 @@ func TestPrepareImage(t *testing.T) {
 		{"testdata/", "whatever/", 0, "", "testdata/", true},
 		{"http://test.url", "testdata/tmp/", 200, "testdata/test.tar", "testdata/tmp/", true},
 		{"testdata/test.tar", "testdata/tmp/", 0, "", "testdata/tmp/", true},
+		{"archive/testdata/text.tar.gz", "testdata/tmp/", 0, "", "testdata/tmp/", true},
+		{"archive/testdata/busybox.deb", "testdata/tmp/", 0, "", "testdata/tmp/", true},
+		{"http://test.url/busybox.zip", "testdata/tmp/", 200, "archive/testdata/busybox.zip", "testdata/tmp/", true},
+		{"http://test.url/text.tar.zst", "testdata/tmp/", 200, "archive/testdata/text.tar.zst", "testdata/tmp/", true},
 		{"*?<notapath", "whatever/", 0, "", "", false},
 	}
 
@@ -97,3 +116,481 @@ func TestPrepareImage(t *testing.T) {
 	}
 
 }
+
+func TestPrepareImageDigest(t *testing.T) {
+
+	content, err := ioutil.ReadFile("archive/testdata/text.tar.gz")
+	if err != nil {
+		t.Fatalf("Couldn't read test image: %s", err)
+	}
+	sum := sha256.Sum256(content)
+	good := "sha256:" + hex.EncodeToString(sum[:])
+	bad := "sha256:" + strings.Repeat("0", 64)
+
+	var testData = []struct {
+		path      string // image path
+		digest    string // digest set at the Image
+		prepareOK bool   // whether prepare should succeed
+	}{
+		{"archive/testdata/text.tar.gz", good, true},
+		{"archive/testdata/text.tar.gz", bad, false},
+		{"http://test.url/text.tar.gz#sha256=" + good[7:], "", true},
+		{"http://test.url/text.tar.gz#sha256=" + bad[7:], "", false},
+		{"http://test.url/text.tar.gz#sha256=" + good[7:], bad, false},
+		{"http://test.url/text.tar.gz", good, true},
+		{"testdata/", good, false},
+	}
+
+	for _, td := range testData {
+
+		root, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create root directory: %s", err)
+		}
+		defer os.RemoveAll(root)
+
+		server, client := mockedResource(200, content)
+		defer server.Close()
+
+		i := Image{Client: client, Digest: td.digest}
+		_, err = i.Prepare(td.path, root)
+		if err != nil {
+			if td.prepareOK {
+				t.Errorf("Couldn't prepare image at %q with digest %q: %s", td.path, td.digest, err)
+			}
+
+			// nothing must be extracted on failure
+			if items, _ := ioutil.ReadDir(root); len(items) != 0 {
+				t.Errorf("Failed prepare for image at %q with digest %q left contents in root", td.path, td.digest)
+			}
+			continue
+		}
+
+		if !td.prepareOK {
+			t.Errorf("Image prepare for %q with digest %q should have failed, but did not", td.path, td.digest)
+		}
+	}
+}
+
+func TestPrepareImageVerifyBeforeReplace(t *testing.T) {
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "extracted", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	tw.Write([]byte("data"))
+	tw.Close()
+
+	image, err := ioutil.TempFile("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create test image: %s", err)
+	}
+	defer os.Remove(image.Name())
+	image.Write(buf.Bytes())
+	image.Close()
+
+	sum := sha256.Sum256(buf.Bytes())
+	good := "sha256:" + hex.EncodeToString(sum[:])
+	bad := "sha256:" + strings.Repeat("0", 64)
+
+	var testData = []struct {
+		digest   string // digest set at the Image
+		replaced bool   // whether root contents should be replaced
+	}{
+		{bad, false},
+		{good, true},
+	}
+
+	for _, td := range testData {
+
+		root, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create root directory: %s", err)
+		}
+		defer os.RemoveAll(root)
+		ioutil.WriteFile(filepath.Join(root, "previous"), []byte("previous"), 0644)
+
+		i := Image{Digest: td.digest}
+		_, err = i.Prepare(image.Name(), root)
+
+		_, mismatch := err.(*verify.DigestMismatchError)
+		if td.replaced && err != nil {
+			t.Errorf("Error preparing image with digest %q: %s", td.digest, err)
+		}
+		if !td.replaced && !mismatch {
+			t.Errorf("Image with digest %q should have failed verification, but returned %v", td.digest, err)
+		}
+
+		// mismatches are found while extracting to staging, before root is replaced
+		_, errPrevious := os.Stat(filepath.Join(root, "previous"))
+		_, errExtracted := os.Stat(filepath.Join(root, "extracted"))
+		if (errPrevious == nil) == td.replaced || (errExtracted == nil) != td.replaced {
+			t.Errorf("Root after preparing image with digest %q has previous: %v, extracted: %v", td.digest, errPrevious, errExtracted)
+		}
+	}
+}
+
+// minisign returns a minisign public key and a function signing contents with it
+func minisign(t *testing.T, id string) (verify.PublicKey, func([]byte) []byte) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't generate key: %s", err)
+	}
+	pk, err := verify.ParsePublicKey(base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), id...), pub...)))
+	if err != nil {
+		t.Fatalf("Couldn't parse generated key: %s", err)
+	}
+
+	return pk, func(contents []byte) []byte {
+		hash := blake2b.Sum512(contents)
+		sig := ed25519.Sign(priv, hash[:])
+		global := ed25519.Sign(priv, append(append([]byte{}, sig...), "test"...))
+		return []byte("untrusted comment: test\n" +
+			base64.StdEncoding.EncodeToString(append(append([]byte("ED"), id...), sig...)) +
+			"\ntrusted comment: test\n" + base64.StdEncoding.EncodeToString(global) + "\n")
+	}
+}
+
+func TestPrepareImageSignature(t *testing.T) {
+
+	content, err := ioutil.ReadFile("archive/testdata/text.tar.gz")
+	if err != nil {
+		t.Fatalf("Couldn't read test image: %s", err)
+	}
+
+	trusted, sign := minisign(t, "trusted0")
+	_, signUntrusted := minisign(t, "untrust0")
+
+	// signatures served next to images, missing ones are not found
+	files := map[string][]byte{
+		"/signed.tar.gz":            content,
+		"/signed.tar.gz.minisig":    sign(content),
+		"/unsigned.tar.gz":          content,
+		"/untrusted.tar.gz":         content,
+		"/untrusted.tar.gz.minisig": signUntrusted(content),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	// local image with its signature somewhere else
+	sigFile, err := ioutil.TempFile("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create signature file: %s", err)
+	}
+	defer os.Remove(sigFile.Name())
+	sigFile.Write(sign(content))
+	sigFile.Close()
+
+	var testData = []struct {
+		path      string             // image path
+		signature string             // signature path
+		keys      []verify.PublicKey // trusted keys
+		require   bool               // whether signature is required
+		prepareOK bool               // whether prepare should succeed
+	}{
+		{server.URL + "/signed.tar.gz", "", []verify.PublicKey{trusted}, true, true},
+		{server.URL + "/unsigned.tar.gz", "", []verify.PublicKey{trusted}, false, true},
+		{server.URL + "/unsigned.tar.gz", "", []verify.PublicKey{trusted}, true, false},
+		{server.URL + "/untrusted.tar.gz", "", []verify.PublicKey{trusted}, false, false},
+		{server.URL + "/unsigned.tar.gz", server.URL + "/signed.tar.gz.minisig", []verify.PublicKey{trusted}, true, true},
+		{"archive/testdata/text.tar.gz", sigFile.Name(), []verify.PublicKey{trusted}, true, true},
+		{"archive/testdata/text.tar", sigFile.Name(), []verify.PublicKey{trusted}, true, false},
+		{"archive/testdata/text.tar.gz", "", nil, true, false},
+		{"testdata/", "", []verify.PublicKey{trusted}, true, false},
+	}
+
+	for _, td := range testData {
+
+		root, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create root directory: %s", err)
+		}
+		defer os.RemoveAll(root)
+
+		i := Image{Signature: td.signature, TrustedKeys: td.keys, RequireSignature: td.require}
+		_, err = i.Prepare(td.path, root)
+		if err != nil {
+			if td.prepareOK {
+				t.Errorf("Couldn't prepare image at %q with signature %q: %s", td.path, td.signature, err)
+			}
+			if items, _ := ioutil.ReadDir(root); len(items) != 0 {
+				t.Errorf("Failed prepare for image at %q with signature %q left contents in root", td.path, td.signature)
+			}
+			continue
+		}
+
+		if !td.prepareOK {
+			t.Errorf("Image prepare for %q with signature %q should have failed, but did not", td.path, td.signature)
+		}
+	}
+}
+
+func TestPrepareImageStore(t *testing.T) {
+
+	content, err := ioutil.ReadFile("archive/testdata/text.tar.gz")
+	if err != nil {
+		t.Fatalf("Couldn't read test image: %s", err)
+	}
+	sum := sha256.Sum256(content)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	// server supporting ETag revalidation, counting full downloads
+	downloads := 0
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create store directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := store.New(dir)
+	if err != nil {
+		t.Fatalf("Couldn't create store: %s", err)
+	}
+
+	var testData = []struct {
+		digest    string // digest set at the Image
+		requests  int    // expected requests to the server after prepare
+		downloads int    // expected downloads from the server after prepare
+	}{
+		{"", 1, 1},
+		{"", 2, 1},
+		{digest, 2, 1},
+	}
+
+	for _, td := range testData {
+
+		root, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create root directory: %s", err)
+		}
+		defer os.RemoveAll(root)
+
+		i := Image{Store: s, Digest: td.digest}
+		if _, err = i.Prepare(server.URL+"/text.tar.gz", root); err != nil {
+			t.Errorf("Couldn't prepare image with store: %s", err)
+			continue
+		}
+
+		if _, err = os.Stat(filepath.Join(root, "text")); err != nil {
+			t.Errorf("Image prepared from store was not extracted: %s", err)
+		}
+
+		if requests != td.requests || downloads != td.downloads {
+			t.Errorf("Server got %d requests and %d downloads but expected %d and %d", requests, downloads, td.requests, td.downloads)
+		}
+	}
+
+	// verified downloads are kept even by stores smaller than them
+	small, err := store.New(filepath.Join(dir, "small"))
+	if err != nil {
+		t.Fatalf("Couldn't create store: %s", err)
+	}
+	small.MaxSize = 1
+	root, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create root directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+	i := Image{Store: small, Digest: digest}
+	if _, err = i.Prepare(server.URL+"/text.tar.gz", root); err != nil {
+		t.Errorf("Couldn't prepare image with a store smaller than the image: %s", err)
+	}
+	if d, _ := verify.ParseDigest(digest); !small.HasBlob(d) {
+		t.Errorf("Image was not kept by a store smaller than the image")
+	}
+}
+
+func TestPrepareImageSources(t *testing.T) {
+
+	busybox, err := filepath.Abs("archive/testdata/busybox.tar")
+	if err != nil {
+		t.Fatalf("Couldn't get absolute path for busybox tarball: %s", err)
+	}
+
+	var testData = []struct {
+		path      string // image path
+		hostname  string // expected etc/hostname contents, empty if not checked
+		prepareOK bool   // whether prepare should succeed
+	}{
+		{"oci-layout:testdata/oci-layout", "layered\n", true},
+		{"oci-layout:testdata/oci-layout:latest", "layered\n", true},
+		{"oci-layout:testdata/oci-layout:missing", "", false},
+		{"docker-archive:testdata/docker-archive.tar", "layered\n", true},
+		{"docker-archive:testdata/docker-archive.tar:busybox", "layered\n", true},
+		{"docker-archive:testdata/docker-archive.tar:alpine:3", "", false},
+		{"file://" + busybox, "", true},
+		{"file://remote.host" + busybox, "", false},
+	}
+
+	for _, td := range testData {
+
+		root, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create root directory: %s", err)
+		}
+		defer os.RemoveAll(root)
+
+		i := Image{}
+		_, err = i.Prepare(td.path, root)
+		if err != nil {
+			if td.prepareOK {
+				t.Errorf("Couldn't prepare image at %q: %s", td.path, err)
+			}
+			continue
+		}
+		if !td.prepareOK {
+			t.Errorf("Image prepare for %q should have failed, but did not", td.path)
+			continue
+		}
+
+		if content, err := ioutil.ReadFile(filepath.Join(root, "bin/busybox")); err != nil || string(content) != "#!/bin/busybox\n" {
+			t.Errorf("Image %q bin/busybox contains %q (%v)", td.path, content, err)
+		}
+		if td.hostname == "" {
+			continue
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(root, "etc/hostname")); err != nil || string(content) != td.hostname {
+			t.Errorf("Image %q etc/hostname contains %q (%v) but expected %q", td.path, content, err, td.hostname)
+		}
+	}
+}
+
+func TestPrepareImageCopyOnWrite(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	i := Image{CopyOnWrite: true}
+	root, err := i.Prepare("testdata/simple", filepath.Join(dir, "root"))
+	if err != nil {
+		t.Fatalf("Couldn't prepare copy on write image: %s", err)
+	}
+	if root == "testdata/simple" {
+		t.Fatalf("Copy on write image was handed out as the image directory")
+	}
+
+	ioutil.WriteFile(filepath.Join(root, "job.log"), []byte("done\n"), 0644)
+	if _, err = os.Stat("testdata/simple/job.log"); err == nil {
+		os.Remove("testdata/simple/job.log")
+		t.Errorf("Copy on write image directory was written")
+	}
+
+	// preparing again at the same root doesn't stack overlays
+	if _, err = i.Prepare("testdata/simple", filepath.Join(dir, "root")); err == nil {
+		t.Errorf("Preparing copy on write image over an existing root should have failed, but did not")
+	}
+
+	if err = (&Overlay{Dir: filepath.Join(dir, "root")}).Discard(); err != nil {
+		t.Errorf("Error discarding copy on write root: %s", err)
+	}
+}
+
+func TestPrepareImageConfig(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := store.New(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatalf("Couldn't create store: %s", err)
+	}
+
+	var testData = []struct {
+		path string   // image path
+		cmd  []string // expected image command, nil if the image has no config
+	}{
+		{"oci-layout:testdata/oci-layout", []string{"/bin/sh"}},
+		{"docker-archive:testdata/docker-archive.tar", []string{"/bin/sh"}},
+		{"archive/testdata/busybox.tar", nil},
+	}
+
+	for _, td := range testData {
+
+		i := Image{Store: s}
+		_, config, err := i.PrepareConfig(context.Background(), td.path, filepath.Join(dir, "root"))
+		if err != nil {
+			t.Errorf("Couldn't prepare image at %q: %s", td.path, err)
+			continue
+		}
+
+		if td.cmd == nil {
+			if config != nil {
+				t.Errorf("Image %q returned config %+v but expected none", td.path, config)
+			}
+			continue
+		}
+		if config == nil || strings.Join(config.Config.Cmd, " ") != strings.Join(td.cmd, " ") {
+			t.Errorf("Image %q returned config %+v but expected command %q", td.path, config, td.cmd)
+			continue
+		}
+
+		stored, err := s.Config(td.path)
+		if err != nil || stored == nil || strings.Join(stored.Config.Cmd, " ") != strings.Join(td.cmd, " ") {
+			t.Errorf("Image %q stored config is %+v (%v)", td.path, stored, err)
+		}
+	}
+}
+
+func TestPrepareImageRegistry(t *testing.T) {
+
+	// registry serving the test OCI layout image as team/base:1.2
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/v2/team/base/")
+		if path == "manifests/1.2" {
+			path = "manifests/sha256:dbb608f5088fdb9435e21c870f687969f28b53be5b4b3a9664e620610e909fe6"
+		}
+		if i := strings.Index(path, "sha256:"); i >= 0 {
+			http.ServeFile(w, r, filepath.Join("testdata/oci-layout/blobs/sha256", path[i+len("sha256:"):]))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	RegisterSource("docker", RegistrySource(&oci.Registry{Client: server.Client()}))
+	defer RegisterSource("docker", RegistrySource(&oci.Registry{}))
+
+	root, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create root directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	host := strings.TrimPrefix(server.URL, "https://")
+	i := Image{}
+	if _, err = i.Prepare("docker://"+host+"/team/base:1.2", root); err != nil {
+		t.Fatalf("Couldn't prepare image from registry: %s", err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(root, "etc/hostname")); err != nil || string(content) != "layered\n" {
+		t.Errorf("Image from registry etc/hostname contains %q (%v)", content, err)
+	}
+
+	if _, err = i.Prepare("docker://"+host+"/team/missing:1.2", root); err == nil {
+		t.Errorf("Preparing missing image from registry should have failed, but did not")
+	}
+}
@@ -0,0 +1,115 @@
+package net
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// progressInterval is the minimum time between progress reports
+const progressInterval = 100 * time.Millisecond
+
+// progressBarWidth is the number of characters of the rendered bar
+const progressBarWidth = 30
+
+// Progress reports the status of a transfer
+type Progress struct {
+	Transferred int64   // bytes transferred, including those of resumed downloads
+	Total       int64   // bytes expected from Content-Length, -1 if unknown
+	Rate        float64 // bytes per second since the transfer started
+}
+
+// ProgressFunc observes transfers progress
+type ProgressFunc func(Progress)
+
+// progressReader reports progress while a response body is read
+type progressReader struct {
+	io.ReadCloser
+	observer ProgressFunc
+	progress Progress
+	offset   int64 // bytes transferred before this response, not counted for the rate
+	start    time.Time
+	last     time.Time
+}
+
+// newProgressReader wraps body to report its progress, starting at offset
+func newProgressReader(body io.ReadCloser, observer ProgressFunc, offset, length int64) io.ReadCloser {
+	if observer == nil {
+		return body
+	}
+
+	total := int64(-1)
+	if length >= 0 {
+		total = offset + length
+	}
+	now := time.Now()
+	return &progressReader{
+		ReadCloser: body,
+		observer:   observer,
+		progress:   Progress{Transferred: offset, Total: total},
+		offset:     offset,
+		start:      now,
+		last:       now,
+	}
+}
+
+// Read reads the body reporting progress at most every progressInterval, and at the end
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	p.progress.Transferred += int64(n)
+
+	now := time.Now()
+	if err == io.EOF || now.Sub(p.last) >= progressInterval {
+		p.last = now
+		if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+			p.progress.Rate = float64(p.progress.Transferred-p.offset) / elapsed
+		}
+		p.observer(p.progress)
+	}
+	return n, err
+}
+
+// ProgressBar returns an observer that renders a progress bar to a terminal
+// The bar is redrawn in place and ends with a new line once the total is transferred.
+func ProgressBar(w io.Writer) ProgressFunc {
+	return func(p Progress) {
+		if p.Total < 0 {
+			fmt.Fprintf(w, "\r%s %s/s", formatBytes(p.Transferred), formatBytes(int64(p.Rate)))
+			return
+		}
+
+		// wrong lengths can report more transferred than the total
+		ratio := 1.0
+		if p.Total > 0 {
+			ratio = float64(p.Transferred) / float64(p.Total)
+		}
+		if ratio > 1 {
+			ratio = 1
+		} else if ratio < 0 {
+			ratio = 0
+		}
+		filled := int(ratio * progressBarWidth)
+		bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+
+		fmt.Fprintf(w, "\r[%s] %3d%% %s / %s %s/s", bar, int(ratio*100),
+			formatBytes(p.Transferred), formatBytes(p.Total), formatBytes(int64(p.Rate)))
+		if p.Transferred >= p.Total {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// formatBytes returns a size with binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
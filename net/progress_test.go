@@ -0,0 +1,64 @@
+package net
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDownloadProgress(t *testing.T) {
+
+	content := bytes.Repeat([]byte("Die Zeit vergeht wie im Fluge. "), 1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create test directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var reports []Progress
+	r := Resource{Progress: func(p Progress) { reports = append(reports, p) }}
+	if _, err = r.Download(server.URL+"/image", dir); err != nil {
+		t.Fatalf("Error downloading resource: %s", err)
+	}
+
+	if len(reports) == 0 {
+		t.Fatalf("Download progress was not reported")
+	}
+	last := reports[len(reports)-1]
+	if last.Transferred != int64(len(content)) || last.Total != int64(len(content)) {
+		t.Errorf("Last progress reported %+v but expected %d bytes", last, len(content))
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+
+	var testData = []struct {
+		progress Progress // reported progress
+		expected string   // expected rendering
+	}{
+		{Progress{512, 2048, 100}, "\r[=======                       ]  25% 512 B / 2.0 KiB 100 B/s"},
+		{Progress{3 << 20, 3 << 20, 1 << 20}, "\r[==============================] 100% 3.0 MiB / 3.0 MiB 1.0 MiB/s\n"},
+		{Progress{1536, -1, 1024}, "\r1.5 KiB 1.0 KiB/s"},
+		{Progress{4096, 2048, 100}, "\r[==============================] 100% 4.0 KiB / 2.0 KiB 100 B/s\n"},
+		{Progress{-512, 2048, 0}, "\r[                              ]   0% -512 B / 2.0 KiB 0 B/s"},
+	}
+
+	for _, td := range testData {
+		var out strings.Builder
+		ProgressBar(&out)(td.progress)
+		if out.String() != td.expected {
+			t.Errorf("Progress %+v rendered as %q but expected %q", td.progress, out.String(), td.expected)
+		}
+	}
+}
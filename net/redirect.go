@@ -0,0 +1,65 @@
+package net
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// RedirectPolicy configures which redirections are followed
+type RedirectPolicy struct {
+	MaxRedirects int  // redirections followed, 0 to refuse them all
+	SameHost     bool // refuse redirections to a host other than the requested one
+}
+
+// RedirectError is returned when a redirection is refused
+type RedirectError struct {
+	URL    string
+	Reason string
+}
+
+// Error implements the error interface
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("Refused redirection to %q: %s", e.URL, e.Reason)
+}
+
+// check implements http.Client CheckRedirect
+func (p *RedirectPolicy) check(req *http.Request, via []*http.Request) error {
+	if len(via) > p.MaxRedirects {
+		return &RedirectError{URL: req.URL.String(), Reason: fmt.Sprintf("more than %d redirections", p.MaxRedirects)}
+	}
+	if p.SameHost && req.URL.Host != via[0].URL.Host {
+		return &RedirectError{URL: req.URL.String(), Reason: fmt.Sprintf("host differs from %q", via[0].URL.Host)}
+	}
+	return nil
+}
+
+// fileName returns the name of a downloaded resource, empty if none is usable
+// Content-Disposition is preferred over the last element of the final URL path.
+func fileName(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		if name := sanitizeFileName(params["filename"]); name != "" {
+			return name
+		}
+	}
+	if resp.Request == nil {
+		return ""
+	}
+	return sanitizeFileName(path.Base(resp.Request.URL.Path))
+}
+
+// sanitizeFileName keeps the last element of name, without control characters nor leading dots
+func sanitizeFileName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	return strings.TrimLeft(strings.TrimSpace(name), ".")
+}
@@ -0,0 +1,105 @@
+package net
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadRedirect(t *testing.T) {
+
+	// other host serves the image, origin redirects there through a number of hops
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("text"))
+	}))
+	defer other.Close()
+
+	var origin *httptest.Server
+	origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hop":
+			http.Redirect(w, r, origin.URL+"/same", http.StatusFound)
+		case "/same":
+			w.Write([]byte("text"))
+		default:
+			http.Redirect(w, r, other.URL+"/image.tar?token=secret", http.StatusFound)
+		}
+	}))
+	defer origin.Close()
+
+	var testData = []struct {
+		path       string          // requested path at origin
+		policy     *RedirectPolicy // redirect policy
+		file       string          // expected file name
+		downloadOK bool            // whether the download should succeed
+	}{
+		{"/signed", nil, "image.tar", true},
+		{"/signed", &RedirectPolicy{MaxRedirects: 1}, "image.tar", true},
+		{"/signed", &RedirectPolicy{MaxRedirects: 0}, "", false},
+		{"/signed", &RedirectPolicy{MaxRedirects: 1, SameHost: true}, "", false},
+		{"/hop", &RedirectPolicy{MaxRedirects: 1, SameHost: true}, "same", true},
+	}
+
+	for _, td := range testData {
+
+		dir, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create test directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		r := Resource{Redirect: td.policy, Retry: &RetryPolicy{MaxAttempts: 3}}
+		download, err := r.Download(origin.URL+td.path, dir)
+		if err != nil {
+			if td.downloadOK {
+				t.Errorf("Error downloading %q with policy %+v: %s", td.path, td.policy, err)
+			} else if re := (*RedirectError)(nil); !errors.As(err, &re) {
+				t.Errorf("Download of %q with policy %+v failed with %v", td.path, td.policy, err)
+			}
+			continue
+		}
+
+		if !td.downloadOK {
+			t.Errorf("Download of %q with policy %+v should have failed, but did not", td.path, td.policy)
+			continue
+		}
+		if download != filepath.Join(dir, td.file) {
+			t.Errorf("Download of %q named %q but expected %q", td.path, download, td.file)
+		}
+	}
+}
+
+func TestFileName(t *testing.T) {
+
+	var testData = []struct {
+		disposition string // Content-Disposition header
+		url         string // final URL
+		name        string // expected file name
+	}{
+		{"", "http://cdn.test/images/alpine.tar.gz?token=secret", "alpine.tar.gz"},
+		{`attachment; filename="busybox.tar"`, "http://cdn.test/download?id=1", "busybox.tar"},
+		{`attachment; filename*=UTF-8''b%C3%BCsybox.tar`, "http://cdn.test/download", "büsybox.tar"},
+		{`attachment; filename="../../etc/passwd"`, "http://cdn.test/download", "passwd"},
+		{`attachment; filename="..\\..\\boot.ini"`, "http://cdn.test/download", "boot.ini"},
+		{`attachment; filename=".."`, "http://cdn.test/image.tar", "image.tar"},
+		{"", "http://cdn.test/", ""},
+		{"", "http://cdn.test/..%2F.hidden", "hidden"},
+	}
+
+	for _, td := range testData {
+		req, err := http.NewRequest("GET", td.url, nil)
+		if err != nil {
+			t.Fatalf("Couldn't create request for %q: %s", td.url, err)
+		}
+		resp := &http.Response{Header: http.Header{}, Request: req}
+		resp.Header.Set("Content-Disposition", td.disposition)
+
+		if name := fileName(resp); name != td.name {
+			t.Errorf("File name for %q at %q was %q but expected %q", td.disposition, td.url, name, td.name)
+		}
+	}
+}
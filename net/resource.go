@@ -1,66 +1,289 @@
 package net
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
+// partialSuffix is appended to the name of files holding interrupted downloads
+const partialSuffix = ".partial"
+
 // Resource exposes helper methods to access internet resoruces
 type Resource struct {
-	Client *http.Client
+	Client   *http.Client
+	Retry    *RetryPolicy    // retries failed requests, nil to fail on first error
+	Progress ProgressFunc    // observes downloads progress, nil for none
+	Redirect *RedirectPolicy // redirections followed, nil for the client policy
 }
 
-// Download downloads a resource from internet
-// TODO support 302 redirections
-func (r *Resource) Download(resourceURL string, directory string) (string, error) {
+// StatusError is returned when the remote site answers with a non successful status
+type StatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration // wait requested by the remote site, 0 if none
+}
+
+// newStatusError returns the error for an unexpected response
+func newStatusError(resp *http.Response) *StatusError {
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: retryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// Error implements the error interface
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Remote site returned status %s.", e.Status)
+}
+
+// ErrNotModified is returned when a resource still matches the validators of a conditional request
+var ErrNotModified = errors.New("Remote resource not modified")
+
+// Validators identify a version of a remote resource for conditional requests
+type Validators struct {
+	ETag         string
+	LastModified string
+}
+
+// Open requests a resource from internet and returns its contents stream
+// The caller must close the returned stream
+func (r *Resource) Open(resourceURL string) (io.ReadCloser, error) {
+	return r.OpenContext(context.Background(), resourceURL)
+}
+
+// OpenContext requests a resource from internet and returns its contents stream
+// Cancelling ctx aborts the request and reading the stream.
+func (r *Resource) OpenContext(ctx context.Context, resourceURL string) (io.ReadCloser, error) {
+	body, _, err := r.OpenIfModifiedContext(ctx, resourceURL, Validators{})
+	return body, err
+}
+
+// OpenIfModified requests a resource from internet unless it still matches the validators
+// If it didn't change ErrNotModified is returned, otherwise the contents stream along
+// with their validators. The caller must close the returned stream
+// Failed requests are retried according to the resource retry policy.
+func (r *Resource) OpenIfModified(resourceURL string, v Validators) (io.ReadCloser, Validators, error) {
+	return r.OpenIfModifiedContext(context.Background(), resourceURL, v)
+}
+
+// OpenIfModifiedContext requests a resource from internet unless it still matches the validators
+// Cancelling ctx aborts the request, waits between retries and reading the stream.
+func (r *Resource) OpenIfModifiedContext(ctx context.Context, resourceURL string, v Validators) (io.ReadCloser, Validators, error) {
+	var body io.ReadCloser
+	var current Validators
+	err := r.retry(ctx, func() error {
+		var err error
+		body, current, err = r.openIfModified(ctx, resourceURL, v)
+		return err
+	})
+	return body, current, err
+}
+
+// openIfModified makes a single attempt of OpenIfModified
+func (r *Resource) openIfModified(ctx context.Context, resourceURL string, v Validators) (io.ReadCloser, Validators, error) {
+
+	header := http.Header{}
+	if v.ETag != "" {
+		header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		header.Set("If-Modified-Since", v.LastModified)
+	}
+
+	resp, err := r.get(ctx, resourceURL, header)
+	if err != nil {
+		return nil, Validators{}, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && (v.ETag != "" || v.LastModified != "") {
+		resp.Body.Close()
+		return nil, v, ErrNotModified
+	}
+
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, Validators{}, newStatusError(resp)
+	}
+
+	return newProgressReader(resp.Body, r.Progress, 0, resp.ContentLength), responseValidators(resp), nil
+}
+
+// get sends a GET request with extra headers
+func (r *Resource) get(ctx context.Context, resourceURL string, header http.Header) (*http.Response, error) {
 
 	// use a default
 	if r.Client == nil {
 		r.Client = &http.Client{}
 	}
 
-	parsedURL, err := url.Parse(resourceURL)
+	req, err := http.NewRequestWithContext(ctx, "GET", resourceURL, nil)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	client := r.Client
+	if r.Redirect != nil {
+		c := *r.Client
+		c.CheckRedirect = r.Redirect.check
+		client = &c
 	}
+	return client.Do(req)
+}
+
+// responseValidators returns the validators of a response
+func responseValidators(resp *http.Response) Validators {
+	return Validators{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+}
+
+// Download downloads a resource from internet
+// The file is named after the response Content-Disposition or the path of the final URL
+// after redirections. If none is usable a name is generated.
+// Interrupted downloads are kept in a hidden partial file in directory and resumed by
+// the next call when the server supports range requests. Retries resume them the same way.
+func (r *Resource) Download(resourceURL string, directory string) (string, error) {
+	return r.DownloadContext(context.Background(), resourceURL, directory)
+}
 
-	// get name of the resource to download
-	// if name is empty use a default one
-	// TODO remove querystring if present
-	fileName := parsedURL.Path[(strings.LastIndex(parsedURL.Path, "/") + 1):]
+// DownloadContext downloads a resource from internet until ctx is done
+// A cancelled download keeps its partial file to be resumed later.
+func (r *Resource) DownloadContext(ctx context.Context, resourceURL string, directory string) (string, error) {
 
-	resp, err := r.Client.Get(resourceURL)
+	// retries resume the partial download
+	var partial, name string
+	err := r.retry(ctx, func() error {
+		var err error
+		partial, name, err = r.downloadPartial(ctx, resourceURL, directory)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("Remote site returned status %s.", resp.Status)
-	}
-
-	var file *os.File
-	if fileName != "" {
-		file, err = os.Create(filepath.Join(directory, fileName))
+	var fileOut string
+	if name != "" {
+		fileOut = filepath.Join(directory, name)
 	} else {
 		// if no remote file name could be extracted, generate a file name in the target directory
-		file, err = ioutil.TempFile(directory, "isolate")
+		file, err := ioutil.TempFile(directory, "isolate")
+		if err != nil {
+			return "", err
+		}
+		file.Close()
+		fileOut = file.Name()
 	}
 
-	if err != nil {
+	if err = os.Rename(partial, fileOut); err != nil {
 		return "", err
 	}
+	os.Remove(partial + ".json")
+	return fileOut, nil
+}
+
+// downloadPartial downloads a resource to a partial file in directory and returns its path
+// along with the file name the remote site gave to the resource.
+// A partial file left by an interrupted download is resumed with a range request when
+// the server supports them and the resource didn't change, otherwise it's downloaded again.
+// Validators of the resource being downloaded are kept next to the partial file.
+func (r *Resource) downloadPartial(ctx context.Context, resourceURL, directory string) (string, string, error) {
+
+	sum := sha256.Sum256([]byte(resourceURL))
+	partial := filepath.Join(directory, ".fsisolate-"+hex.EncodeToString(sum[:8])+partialSuffix)
+	validatorsFile := partial + ".json"
+
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", "", err
+	}
 	defer file.Close()
 
-	if _, err = io.Copy(file, resp.Body); err != nil {
-		return "", err
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", "", err
+	}
+
+	// resuming is only safe if the resource can be checked to be the same
+	header := http.Header{}
+	var v Validators
+	if offset > 0 {
+		if data, err := ioutil.ReadFile(validatorsFile); err == nil {
+			json.Unmarshal(data, &v)
+		}
+		if ifRange := v.ifRange(); ifRange != "" {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			header.Set("If-Range", ifRange)
+		}
+	}
+
+	resp, err := r.get(ctx, resourceURL, header)
+	if err != nil {
+		removeEmpty(file)
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && header.Get("Range") != "":
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return "", "", fmt.Errorf("Remote site returned unexpected range %q", resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode == 200:
+		// whole resource, start over
+		if err = file.Truncate(0); err != nil {
+			return "", "", err
+		}
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return "", "", err
+		}
+		data, err := json.Marshal(responseValidators(resp))
+		if err != nil {
+			return "", "", err
+		}
+		if err = ioutil.WriteFile(validatorsFile, data, 0644); err != nil {
+			return "", "", err
+		}
+	default:
+		removeEmpty(file)
+		return "", "", newStatusError(resp)
 	}
 
-	return file.Name(), nil
+	start, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", "", err
+	}
+	body := newProgressReader(resp.Body, r.Progress, start, resp.ContentLength)
+	if _, err = io.Copy(file, body); err != nil {
+		return "", "", err
+	}
+	return partial, fileName(resp), file.Close()
+}
+
+// removeEmpty removes a partial file that got no contents
+func removeEmpty(file *os.File) {
+	if fi, err := file.Stat(); err == nil && fi.Size() == 0 {
+		os.Remove(file.Name())
+	}
+}
+
+// ifRange returns the value for an If-Range header, empty if validators can't be used
+// Weak entity tags are not allowed in range requests.
+func (v Validators) ifRange() string {
+	if v.ETag != "" && !strings.HasPrefix(v.ETag, "W/") {
+		return v.ETag
+	}
+	return v.LastModified
 }
@@ -1,6 +1,8 @@
 package net
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -9,6 +11,7 @@ import (
 	"os"
 	"path"
 	"testing"
+	"time"
 )
 
 // mockedResource returns a mocked web server and a client that redirects all request to the server
@@ -143,3 +146,220 @@ func TestDownload(t *testing.T) {
 
 	}
 }
+
+func TestOpen(t *testing.T) {
+
+	var testData = []struct {
+		url    string // resource URL
+		status int    // expected status from URL
+		body   []byte // body returned from URL
+		openOK bool   // whether opening the resource should succeed
+	}{
+		{"http://testsite.test/test1", 200, []byte("text"), true},
+		{"http://testsite.test/test2", 404, []byte("text"), false},
+	}
+
+	for _, td := range testData {
+
+		server, client := mockedResource(td.status, td.body)
+		defer server.Close()
+
+		r := Resource{Client: client}
+
+		body, err := r.Open(td.url)
+		if err != nil {
+			if td.openOK {
+				t.Errorf("Error opening %q: %s", td.url, err)
+			}
+			continue
+		}
+		defer body.Close()
+
+		if !td.openOK {
+			t.Errorf("Opening %q should have failed, but did not", td.url)
+			continue
+		}
+
+		content, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Errorf("Cannot read stream for %q: %s", td.url, err)
+			continue
+		}
+
+		if !equalBytes(content, td.body) {
+			t.Errorf("Stream for %q contains:\n%v\nbut expected:\n%v\n", td.url, content, td.body)
+		}
+	}
+}
+
+func TestOpenIfModified(t *testing.T) {
+
+	etag := `"v1"`
+	lastModified := "Sun, 08 May 2016 09:04:00 GMT"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag || r.Header.Get("If-Modified-Since") == lastModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte("text"))
+	}))
+	defer server.Close()
+
+	var testData = []struct {
+		validators  Validators // validators sent
+		notModified bool       // whether the resource should be reported as not modified
+	}{
+		{Validators{}, false},
+		{Validators{ETag: `"v0"`}, false},
+		{Validators{ETag: etag}, true},
+		{Validators{LastModified: lastModified}, true},
+	}
+
+	for _, td := range testData {
+
+		r := Resource{}
+		body, v, err := r.OpenIfModified(server.URL, td.validators)
+		if err == ErrNotModified {
+			if !td.notModified {
+				t.Errorf("Resource reported as not modified for validators %+v", td.validators)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error opening resource with validators %+v: %s", td.validators, err)
+			continue
+		}
+		body.Close()
+
+		if td.notModified {
+			t.Errorf("Resource should be reported as not modified for validators %+v", td.validators)
+			continue
+		}
+
+		if v.ETag != etag || v.LastModified != lastModified {
+			t.Errorf("Resource validators returned as %+v", v)
+		}
+	}
+}
+
+// droppingServer returns a server that drops the connection halfway through the first response
+// Later responses return version contents with its entity tag, honoring ranges if supported.
+func droppingServer(content []byte, version []byte, etag string, ranges bool) (*httptest.Server, *[]string) {
+	var received []string
+	first := true
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("Range"))
+
+		if first {
+			first = false
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+
+		w.Header().Set("ETag", etag)
+		if ranges {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(version))
+			return
+		}
+		w.Write(version)
+	}))
+	return s, &received
+}
+
+func TestDownloadResume(t *testing.T) {
+
+	content := bytes.Repeat([]byte("Die Zeit vergeht wie im Fluge. "), 1024)
+	changed := bytes.Repeat([]byte("Changed contents. "), 1024)
+
+	var testData = []struct {
+		version []byte // contents after the connection drop
+		etag    string // entity tag after the connection drop
+		ranges  bool   // whether the server supports ranges
+	}{
+		{content, `"v1"`, true},
+		{changed, `"v2"`, true},
+		{content, `"v1"`, false},
+	}
+
+	for _, td := range testData {
+
+		server, received := droppingServer(content, td.version, td.etag, td.ranges)
+		defer server.Close()
+
+		dir, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create test directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		r := Resource{}
+		if _, err = r.Download(server.URL+"/image", dir); err == nil {
+			t.Errorf("Download with dropped connection should have failed, but did not")
+			continue
+		}
+
+		download, err := r.Download(server.URL+"/image", dir)
+		if err != nil {
+			t.Errorf("Error resuming download: %s", err)
+			continue
+		}
+
+		downloaded, err := ioutil.ReadFile(download)
+		if err != nil || !bytes.Equal(downloaded, td.version) {
+			t.Errorf("Resumed download for version %s contains %d bytes (%v)", td.etag, len(downloaded), err)
+		}
+
+		// servers decide whether to resume, the client always asks for the rest
+		if (*received)[1] != fmt.Sprintf("bytes=%d-", len(content)/2) {
+			t.Errorf("Download for version %s sent range %q", td.etag, (*received)[1])
+		}
+
+		if items, _ := ioutil.ReadDir(dir); len(items) != 1 {
+			t.Errorf("Download left %d files in directory", len(items))
+		}
+	}
+}
+
+func TestDownloadContext(t *testing.T) {
+
+	// server sends part of the resource and stalls
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", "8")
+		w.Write([]byte("text"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create test directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	r := Resource{Retry: &RetryPolicy{MaxAttempts: 5, Backoff: time.Second}}
+	if _, err = r.DownloadContext(ctx, server.URL+"/image", dir); err != context.DeadlineExceeded {
+		t.Errorf("Download with expired context returned %v", err)
+	}
+
+	// partial contents are kept to resume later
+	items, err := ioutil.ReadDir(dir)
+	if err != nil || len(items) != 2 {
+		t.Errorf("Cancelled download left %d files (%v) but expected partial file and validators", len(items), err)
+	}
+}
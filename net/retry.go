@@ -0,0 +1,133 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	stdnet "net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy configures how failed requests are retried
+// Timeouts, reset or refused connections, interrupted transfers and retryable status codes are retried,
+// waiting an exponential backoff between attempts unless the server asks for longer with Retry-After.
+// Download retries the whole transfer, resuming interrupted ones. Open and OpenIfModified only
+// retry opening the request: once the stream is returned, errors reading it are not retried.
+type RetryPolicy struct {
+	MaxAttempts int           // attempts including the first one, 0 or 1 to not retry
+	Backoff     time.Duration // wait before the first retry, doubled on every retry
+	MaxBackoff  time.Duration // maximum wait between attempts, also for Retry-After, 0 for no limit
+	Jitter      float64       // fraction of the backoff randomly removed, between 0 and 1
+	RetryStatus []int         // status codes to retry, nil for the default ones
+}
+
+// defaultRetryStatus are status codes considered transient
+var defaultRetryStatus = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// DefaultRetryPolicy returns a policy suitable for flaky artifact servers
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 5,
+		Backoff:     time.Second,
+		MaxBackoff:  30 * time.Second,
+		Jitter:      0.2,
+	}
+}
+
+// retry calls fn until it succeeds, fails with an error that can't be retried or runs out of attempts
+// Once ctx is done the context error is returned.
+func (r *Resource) retry(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil || r.Retry == nil || attempt >= r.Retry.MaxAttempts || !r.Retry.retryable(err) {
+			return err
+		}
+
+		timer := time.NewTimer(r.Retry.wait(attempt, err))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable reports whether a failed attempt can be retried
+// Only retryable status codes, timeouts, reset or refused connections and interrupted transfers
+// are retried. Other errors, such as invalid requests, refused redirections or certificates
+// that can't be verified, fail the same way every time.
+func (p *RetryPolicy) retryable(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		status := p.RetryStatus
+		if status == nil {
+			status = defaultRetryStatus
+		}
+		for _, s := range status {
+			if s == se.StatusCode {
+				return true
+			}
+		}
+		return false
+	}
+
+	var ne stdnet.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// wait returns how long to wait after a failed attempt
+func (p *RetryPolicy) wait(attempt int, err error) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && (p.MaxBackoff == 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(p.Jitter * rand.Float64() * float64(d))
+	}
+
+	// servers asking for a longer wait are honored up to the maximum
+	if se, ok := err.(*StatusError); ok && se.RetryAfter > d {
+		d = se.RetryAfter
+		if p.MaxBackoff > 0 && d > p.MaxBackoff {
+			d = p.MaxBackoff
+		}
+	}
+	return d
+}
+
+// retryAfter parses a Retry-After header, which is either seconds or a date
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
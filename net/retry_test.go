@@ -0,0 +1,166 @@
+package net
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	stdnet "net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryDownload(t *testing.T) {
+
+	var testData = []struct {
+		failures    int    // requests failing before success
+		status      int    // status of failing requests
+		retryAfter  string // Retry-After header of failing requests
+		maxAttempts int    // attempts allowed
+		requests    int    // expected requests
+		downloadOK  bool   // whether the download should succeed
+	}{
+		{2, http.StatusServiceUnavailable, "", 3, 3, true},
+		{2, http.StatusServiceUnavailable, "0", 2, 2, false},
+		{1, http.StatusTooManyRequests, "1", 2, 2, true},
+		{1, http.StatusNotFound, "", 3, 1, false},
+		{0, 0, "", 0, 1, true},
+	}
+
+	for _, td := range testData {
+
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests <= td.failures {
+				if td.retryAfter != "" {
+					w.Header().Set("Retry-After", td.retryAfter)
+				}
+				w.WriteHeader(td.status)
+				return
+			}
+			w.Write([]byte("text"))
+		}))
+		defer server.Close()
+
+		dir, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create test directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		r := Resource{Retry: &RetryPolicy{MaxAttempts: td.maxAttempts, Backoff: time.Millisecond}}
+		start := time.Now()
+		_, err = r.Download(server.URL+"/image", dir)
+		if (err == nil) != td.downloadOK {
+			t.Errorf("Download after %d failures with status %d returned %v", td.failures, td.status, err)
+		}
+		if requests != td.requests {
+			t.Errorf("Download after %d failures with status %d made %d requests but expected %d", td.failures, td.status, requests, td.requests)
+		}
+		if td.retryAfter == "1" && time.Since(start) < time.Second {
+			t.Errorf("Download didn't honor Retry-After %q", td.retryAfter)
+		}
+	}
+}
+
+func TestRetryResume(t *testing.T) {
+
+	content := []byte("Die Zeit vergeht wie im Fluge")
+	server, received := droppingServer(content, content, `"v1"`, true)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create test directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := Resource{Retry: &RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond}}
+	download, err := r.Download(server.URL+"/image", dir)
+	if err != nil {
+		t.Fatalf("Error downloading with dropped connection: %s", err)
+	}
+
+	if downloaded, err := ioutil.ReadFile(download); err != nil || string(downloaded) != string(content) {
+		t.Errorf("Download contains %q (%v)", downloaded, err)
+	}
+	if len(*received) != 2 || (*received)[1] == "" {
+		t.Errorf("Download retry sent ranges %q", *received)
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+
+	policy := &RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+
+	var testData = []struct {
+		attempt int           // failed attempt
+		err     error         // attempt error
+		wait    time.Duration // expected wait
+	}{
+		{1, io.ErrUnexpectedEOF, time.Second},
+		{2, io.ErrUnexpectedEOF, 2 * time.Second},
+		{3, io.ErrUnexpectedEOF, 4 * time.Second},
+		{4, io.ErrUnexpectedEOF, 5 * time.Second},
+		{1, &StatusError{StatusCode: 503, RetryAfter: 3 * time.Second}, 3 * time.Second},
+		{1, &StatusError{StatusCode: 503, RetryAfter: 10 * time.Second}, 5 * time.Second},
+		{1, &StatusError{StatusCode: 503, RetryAfter: 999999 * time.Second}, 5 * time.Second},
+		{3, &StatusError{StatusCode: 503, RetryAfter: time.Second}, 4 * time.Second},
+	}
+
+	for _, td := range testData {
+		if wait := policy.wait(td.attempt, td.err); wait != td.wait {
+			t.Errorf("Wait after attempt %d failed with %v was %s but expected %s", td.attempt, td.err, wait, td.wait)
+		}
+	}
+
+	// jitter only shortens waits
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if wait := policy.wait(2, errors.New("failure")); wait > 2*time.Second || wait < time.Second {
+			t.Fatalf("Wait with jitter was %s", wait)
+		}
+	}
+}
+
+// timeoutError is a network error reporting a timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryable(t *testing.T) {
+
+	policy := &RetryPolicy{}
+	refused := &url.Error{Op: "Get", URL: "http://test.url", Err: &stdnet.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}
+	reset := &url.Error{Op: "Get", URL: "http://test.url", Err: &stdnet.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}}
+
+	var testData = []struct {
+		err       error // attempt error
+		retryable bool  // whether the attempt should be retried
+	}{
+		{&StatusError{StatusCode: 503}, true},
+		{&StatusError{StatusCode: 404}, false},
+		{io.ErrUnexpectedEOF, true},
+		{&url.Error{Op: "Get", URL: "http://test.url", Err: timeoutError{}}, true},
+		{refused, true},
+		{reset, true},
+		{&url.Error{Op: "Get", URL: "https://test.url", Err: x509.UnknownAuthorityError{}}, false},
+		{&url.Error{Op: "Get", URL: "http://test.url", Err: &RedirectError{}}, false},
+		{&url.Error{Op: "parse", URL: "::", Err: errors.New("missing protocol scheme")}, false},
+		{errors.New("failure"), false},
+	}
+
+	for _, td := range testData {
+		if retryable := policy.retryable(td.err); retryable != td.retryable {
+			t.Errorf("Attempt failed with %v was retryable %t but expected %t", td.err, retryable, td.retryable)
+		}
+	}
+}
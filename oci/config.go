@@ -0,0 +1,71 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ImageConfig is the configuration of an image
+type ImageConfig struct {
+	Architecture string          `json:"architecture,omitempty"`
+	OS           string          `json:"os,omitempty"`
+	Config       ContainerConfig `json:"config"`
+}
+
+// ContainerConfig holds the defaults to run processes from an image
+type ContainerConfig struct {
+	User       string   `json:"User,omitempty"`
+	Env        []string `json:"Env,omitempty"`
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+}
+
+// Config returns the configuration of an image in the layout
+func (l *Layout) Config(m *Manifest) (*ImageConfig, error) {
+	config := &ImageConfig{}
+	if err := l.readBlob(m.Config, config); err != nil {
+		return nil, fmt.Errorf("Error reading image config %s: %s", m.Config.Digest, err.Error())
+	}
+	return config, nil
+}
+
+// Config returns the configuration of an image in the registry
+func (r *Registry) Config(ctx context.Context, ref Reference, m *Manifest) (*ImageConfig, error) {
+	blob, err := r.OpenBlob(ctx, ref, m.Config)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	config, err := decodeConfig(blob)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading image config %s for %s: %s", m.Config.Digest, ref, err.Error())
+	}
+	return config, nil
+}
+
+// Config returns the configuration of an image in the archive
+func (a *DockerArchive) Config(m *DockerManifest) (*ImageConfig, error) {
+	config := &ImageConfig{}
+	if err := a.readJSON(m.Config, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// decodeConfig reads a whole configuration, so that its digest is verified
+func decodeConfig(r io.Reader) (*ImageConfig, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxManifestSize))
+	if err != nil {
+		return nil, err
+	}
+	config := &ImageConfig{}
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
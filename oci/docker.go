@@ -0,0 +1,164 @@
+package oci
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/odacremolbap/fsisolate/verify"
+)
+
+// dockerManifestFile lists the images in a docker save archive
+const dockerManifestFile = "manifest.json"
+
+// maxDockerLinks bounds symlinks followed between docker archive members
+const maxDockerLinks = 16
+
+// DockerManifest describes an image in a docker save archive
+type DockerManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// DockerArchive is an image archive written by docker save
+// Members are indexed when opened, so that layers can be read without extracting the archive.
+type DockerArchive struct {
+	Path    string
+	members map[string]dockerMember
+}
+
+// dockerMember locates a file inside a docker save archive
+type dockerMember struct {
+	offset   int64
+	size     int64
+	linkname string // target of symlinked members, relative to the archive root
+}
+
+// OpenDockerArchive indexes the docker save archive at path
+// The archive must not be compressed.
+func OpenDockerArchive(archive string) (*DockerArchive, error) {
+	file, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	a := &DockerArchive{Path: archive, members: map[string]dockerMember{}}
+	tr := tar.NewReader(file)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error reading docker archive %q: %s", archive, err.Error())
+		}
+
+		name := path.Clean(header.Name)
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			// tar reader doesn't read ahead, so the file is at the member contents
+			offset, err := file.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			a.members[name] = dockerMember{offset: offset, size: header.Size}
+		case tar.TypeSymlink:
+			a.members[name] = dockerMember{linkname: path.Join(path.Dir(name), header.Linkname)}
+		}
+	}
+
+	if _, ok := a.members[dockerManifestFile]; !ok {
+		return nil, fmt.Errorf("Docker archive %q has no %s", archive, dockerManifestFile)
+	}
+	return a, nil
+}
+
+// Manifest returns the image tagged ref, which can be omitted if the archive has a single image
+// References without tag are looked up as "latest".
+func (a *DockerArchive) Manifest(ref string) (*DockerManifest, error) {
+	var manifests []DockerManifest
+	if err := a.readJSON(dockerManifestFile, &manifests); err != nil {
+		return nil, err
+	}
+
+	if ref == "" {
+		if len(manifests) != 1 {
+			return nil, fmt.Errorf("Docker archive %q holds %d images, a reference is needed", a.Path, len(manifests))
+		}
+		return &manifests[0], nil
+	}
+
+	if !strings.Contains(path.Base(ref), ":") {
+		ref += ":latest"
+	}
+	for i := range manifests {
+		for _, tag := range manifests[i].RepoTags {
+			if tag == ref {
+				return &manifests[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("No image tagged %q in docker archive %q", ref, a.Path)
+}
+
+// Open opens a member of the archive
+// Members stored as content addressed blobs are verified against their name at the end of the stream.
+func (a *DockerArchive) Open(name string) (io.ReadCloser, error) {
+	name = path.Clean(name)
+	m, ok := a.members[name]
+	for i := 0; ok && m.linkname != ""; i++ {
+		if i == maxDockerLinks {
+			return nil, fmt.Errorf("Too many links resolving %q in docker archive %q", name, a.Path)
+		}
+		m, ok = a.members[m.linkname]
+	}
+	if !ok {
+		return nil, fmt.Errorf("No file %q in docker archive %q", name, a.Path)
+	}
+
+	file, err := os.Open(a.Path)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = io.NewSectionReader(file, m.offset, m.size)
+
+	// newer docker versions store blobs/<algorithm>/<hex>
+	if parts := strings.Split(name, "/"); len(parts) == 3 && parts[0] == "blobs" {
+		vr, err := verify.NewReader(r, verify.Digest{Algorithm: parts[1], Hex: parts[2]})
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		r = vr
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, file}, nil
+}
+
+// readJSON decodes a JSON member
+func (a *DockerArchive) readJSON(name string, v interface{}) error {
+	r, err := a.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Error decoding %q in docker archive %q: %s", name, a.Path, err.Error())
+	}
+	return nil
+}
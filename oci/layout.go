@@ -0,0 +1,132 @@
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/odacremolbap/fsisolate/verify"
+)
+
+// layoutFile marks a directory as an OCI image layout
+const layoutFile = "oci-layout"
+
+// Layout is an OCI image layout directory
+type Layout struct {
+	Dir string
+}
+
+// OpenLayout returns the image layout at dir
+func OpenLayout(dir string) (*Layout, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, layoutFile))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading OCI image layout %q: %s", dir, err.Error())
+	}
+
+	var layout struct {
+		Version string `json:"imageLayoutVersion"`
+	}
+	if err = json.Unmarshal(data, &layout); err != nil {
+		return nil, fmt.Errorf("Error reading OCI image layout %q: %s", dir, err.Error())
+	}
+	if layout.Version != "1.0.0" {
+		return nil, fmt.Errorf("Unsupported OCI image layout version %q", layout.Version)
+	}
+	return &Layout{Dir: dir}, nil
+}
+
+// BlobPath returns the path of a blob in the layout
+func (l *Layout) BlobPath(d Descriptor) (string, error) {
+	digest, err := verify.ParseDigest(d.Digest)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.Dir, "blobs", digest.Algorithm, digest.Hex), nil
+}
+
+// OpenBlob opens a blob in the layout
+// Contents are verified against the descriptor digest at the end of the stream.
+func (l *Layout) OpenBlob(d Descriptor) (io.ReadCloser, error) {
+	digest, err := verify.ParseDigest(d.Digest)
+	if err != nil {
+		return nil, err
+	}
+	path, err := l.BlobPath(d)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	vr, err := verify.NewReader(file, digest)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{vr, file}, nil
+}
+
+// Manifest returns the manifest named ref for a platform
+// An empty ref is only valid if the layout has a single image. Nested indexes are followed.
+func (l *Layout) Manifest(ref string, platform Platform) (*Manifest, error) {
+	index := &Index{}
+	if err := readJSON(filepath.Join(l.Dir, "index.json"), index); err != nil {
+		return nil, err
+	}
+	if ref == "" && len(index.Manifests) > 1 {
+		return nil, fmt.Errorf("OCI image layout %q holds %d images, a reference is needed", l.Dir, len(index.Manifests))
+	}
+
+	d, err := SelectManifest(index, ref, platform)
+	for err == nil && IsIndex(d.MediaType) {
+		index = &Index{}
+		if err = l.readBlob(d, index); err != nil {
+			return nil, err
+		}
+		d, err = SelectManifest(index, "", platform)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	if err = l.readBlob(d, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// readBlob decodes a JSON blob
+func (l *Layout) readBlob(d Descriptor, v interface{}) error {
+	blob, err := l.OpenBlob(d)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// readJSON decodes a JSON file
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Error decoding %q: %s", path, err.Error())
+	}
+	return nil
+}
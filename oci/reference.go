@@ -0,0 +1,81 @@
+package oci
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Docker Hub defaults for references without registry
+const (
+	dockerHubName     = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+	dockerHubLibrary  = "library/"
+	defaultTag        = "latest"
+)
+
+// Reference is an image in a registry, by tag or digest
+type Reference struct {
+	Registry   string // registry host and port
+	Repository string
+	Tag        string
+	Digest     string // digest pinning the manifest, tag is ignored when set
+}
+
+// ParseReference parses references like registry.local/team/base:1.2 or base@sha256:<hex>
+// References without registry host point to Docker Hub, without tag nor digest to "latest".
+func ParseReference(s string) (Reference, error) {
+	var ref Reference
+
+	name := s
+	if i := strings.Index(name, "@"); i >= 0 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+
+	// the first component is a host if it looks like one
+	if i := strings.Index(name, "/"); i >= 0 && (strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		ref.Registry = name[:i]
+		name = name[i+1:]
+	} else {
+		ref.Registry = dockerHubName
+	}
+	if ref.Registry == dockerHubName {
+		ref.Registry = dockerHubRegistry
+		if !strings.Contains(name, "/") {
+			name = dockerHubLibrary + name
+		}
+	}
+
+	if name == "" || strings.ToLower(name) != name {
+		return Reference{}, fmt.Errorf("Invalid image reference %q", s)
+	}
+	ref.Repository = name
+	return ref, nil
+}
+
+// String returns the reference in registry/repository[:tag][@digest] form
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// manifestRef returns what identifies the manifest in registry requests
+func (r Reference) manifestRef() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
@@ -0,0 +1,37 @@
+package oci
+
+import "testing"
+
+func TestParseReference(t *testing.T) {
+
+	var testData = []struct {
+		ref      string    // reference to parse
+		expected Reference // expected parsed reference
+		parseOK  bool      // whether parsing should succeed
+	}{
+		{"registry.local/team/base:1.2", Reference{"registry.local", "team/base", "1.2", ""}, true},
+		{"localhost:5000/base", Reference{"localhost:5000", "base", "latest", ""}, true},
+		{"localhost/base@sha256:abc", Reference{"localhost", "base", "", "sha256:abc"}, true},
+		{"busybox", Reference{"registry-1.docker.io", "library/busybox", "latest", ""}, true},
+		{"team/base:1.2", Reference{"registry-1.docker.io", "team/base", "1.2", ""}, true},
+		{"registry.local/Team/base", Reference{}, false},
+		{"registry.local/", Reference{}, false},
+	}
+
+	for _, td := range testData {
+		ref, err := ParseReference(td.ref)
+		if err != nil {
+			if td.parseOK {
+				t.Errorf("Error parsing reference %q: %s", td.ref, err)
+			}
+			continue
+		}
+		if !td.parseOK {
+			t.Errorf("Parsing reference %q should have failed, but did not", td.ref)
+			continue
+		}
+		if ref != td.expected {
+			t.Errorf("Reference %q parsed as %+v but expected %+v", td.ref, ref, td.expected)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/odacremolbap/fsisolate/verify"
+)
+
+// maxManifestSize bounds manifests and tokens read from registries
+const maxManifestSize = 4 << 20
+
+// manifestAccept are the manifest media types requested from registries
+var manifestAccept = strings.Join([]string{MediaTypeManifest, MediaTypeIndex, MediaTypeDockerManifest, MediaTypeDockerList}, ", ")
+
+// Registry pulls images from an OCI distribution registry
+// Registries asking for bearer tokens are authenticated with their token service,
+// sending the credentials if set. Tokens are kept by repository.
+type Registry struct {
+	Client    *http.Client // http configured client, nil for a default one
+	PlainHTTP bool         // use http instead of https
+	Username  string       // credentials for the registry or its token service
+	Password  string
+	Platform  *Platform // platform selected from image indexes, nil for the running one
+
+	mu     sync.Mutex
+	tokens map[string]string // authorization header by repository
+}
+
+// Manifest returns the image manifest for a reference
+// Image indexes are resolved to the manifest for the registry platform.
+// Manifests are verified against the reference digest, or the index digest when found through one.
+func (r *Registry) Manifest(ctx context.Context, ref Reference) (*Manifest, error) {
+	platform := DefaultPlatform()
+	if r.Platform != nil {
+		platform = *r.Platform
+	}
+
+	id, digest := ref.manifestRef(), ref.Digest
+	for {
+		data, mediaType, err := r.fetchManifest(ctx, ref, id, digest)
+		if err != nil {
+			return nil, err
+		}
+
+		if !IsIndex(mediaType) {
+			manifest := &Manifest{}
+			if err = json.Unmarshal(data, manifest); err != nil {
+				return nil, fmt.Errorf("Error decoding manifest for %s: %s", ref, err.Error())
+			}
+			return manifest, nil
+		}
+
+		index := &Index{}
+		if err = json.Unmarshal(data, index); err != nil {
+			return nil, fmt.Errorf("Error decoding index for %s: %s", ref, err.Error())
+		}
+		d, err := SelectManifest(index, "", platform)
+		if err != nil {
+			return nil, fmt.Errorf("Error selecting manifest for %s: %s", ref, err.Error())
+		}
+		id, digest = d.Digest, d.Digest
+	}
+}
+
+// OpenBlob downloads a blob of an image repository
+// Contents are verified against the descriptor digest at the end of the stream.
+func (r *Registry) OpenBlob(ctx context.Context, ref Reference, d Descriptor) (io.ReadCloser, error) {
+	digest, err := verify.ParseDigest(d.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.get(ctx, ref, "/blobs/"+d.Digest, "")
+	if err != nil {
+		return nil, err
+	}
+	vr, err := verify.NewReader(resp.Body, digest)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{vr, resp.Body}, nil
+}
+
+// fetchManifest downloads a manifest by tag or digest, verifying it if digest is set
+func (r *Registry) fetchManifest(ctx context.Context, ref Reference, id, digest string) ([]byte, string, error) {
+	resp, err := r.get(ctx, ref, "/manifests/"+id, manifestAccept)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = io.LimitReader(resp.Body, maxManifestSize)
+	if digest != "" {
+		d, err := verify.ParseDigest(digest)
+		if err != nil {
+			return nil, "", err
+		}
+		if body, err = verify.NewReader(body, d); err != nil {
+			return nil, "", err
+		}
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error reading manifest %s for %s: %s", id, ref, err.Error())
+	}
+
+	// registries might answer with a generic content type, the document tells too
+	mediaType := resp.Header.Get("Content-Type")
+	if i := strings.Index(mediaType, ";"); i >= 0 {
+		mediaType = mediaType[:i]
+	}
+	var doc struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(data, &doc) == nil && doc.MediaType != "" {
+		mediaType = doc.MediaType
+	}
+	return data, mediaType, nil
+}
+
+// get requests a path of the repository API, authenticating if the registry asks to
+func (r *Registry) get(ctx context.Context, ref Reference, path, accept string) (*http.Response, error) {
+	scheme := "https"
+	if r.PlainHTTP {
+		scheme = "http"
+	}
+	u := scheme + "://" + ref.Registry + "/v2/" + ref.Repository + path
+
+	do := func(authorization string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return r.client().Do(req)
+	}
+
+	resp, err := do(r.token(ref.Repository))
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		var authorization string
+		if authorization, err = r.authenticate(ctx, ref, challenge); err != nil {
+			return nil, err
+		}
+		resp, err = do(authorization)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Registry returned status %s for %s", resp.Status, u)
+	}
+	return resp, nil
+}
+
+// client returns the configured http client, or the default one
+// Registries are shared by concurrent pulls, so the default is never stored.
+func (r *Registry) client() *http.Client {
+	if r.Client == nil {
+		return http.DefaultClient
+	}
+	return r.Client
+}
+
+// token returns the authorization header kept for a repository
+func (r *Registry) token(repository string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tokens[repository]
+}
+
+// authenticate answers a registry challenge and keeps the resulting authorization header
+func (r *Registry) authenticate(ctx context.Context, ref Reference, challenge string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+
+	var authorization string
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if r.Username == "" {
+			return "", fmt.Errorf("Registry %s requires credentials", ref.Registry)
+		}
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(r.Username, r.Password)
+		authorization = req.Header.Get("Authorization")
+	case "bearer":
+		token, err := r.fetchToken(ctx, ref, params)
+		if err != nil {
+			return "", err
+		}
+		authorization = "Bearer " + token
+	default:
+		return "", fmt.Errorf("Registry %s asked for unsupported authentication %q", ref.Registry, challenge)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tokens == nil {
+		r.tokens = map[string]string{}
+	}
+	r.tokens[ref.Repository] = authorization
+	return authorization, nil
+}
+
+// fetchToken requests a pull token from the token service of a bearer challenge
+func (r *Registry) fetchToken(ctx context.Context, ref Reference, params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("Registry %s token realm %q is invalid", ref.Registry, params["realm"])
+	}
+
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + ref.Repository + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if r.Username != "" {
+		req.SetBasicAuth(r.Username, r.Password)
+	}
+	resp, err := r.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Token service returned status %s for %s", resp.Status, ref)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&token); err != nil {
+		return "", fmt.Errorf("Error decoding token for %s: %s", ref, err.Error())
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", fmt.Errorf("Token service returned no token for %s", ref)
+	}
+	return token.Token, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header like Bearer realm="...",service="..."
+func parseChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	header = strings.TrimSpace(header)
+	i := strings.Index(header, " ")
+	if i < 0 {
+		return header, params
+	}
+	scheme, rest := header[:i], header[i+1:]
+
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
@@ -0,0 +1,138 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/odacremolbap/fsisolate/verify"
+)
+
+// testLayout is the OCI image layout served by the test registry
+const testLayout = "../testdata/oci-layout"
+
+// tamperedDigest is served with contents that don't match it
+const tamperedDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+// testRegistry serves the test layout image as team/base:1.2 behind bearer token authentication
+// The tag points to an index with a manifest for the running platform and a bogus one for another.
+func testRegistry(t *testing.T) (*httptest.Server, *int) {
+	index := &Index{}
+	if err := readJSON(filepath.Join(testLayout, "index.json"), index); err != nil {
+		t.Fatalf("Couldn't read test layout index: %s", err)
+	}
+	platform := DefaultPlatform()
+	other := Platform{OS: "plan9", Architecture: platform.Architecture}
+	tagged, err := json.Marshal(Index{SchemaVersion: 2, MediaType: MediaTypeIndex, Manifests: []Descriptor{
+		{MediaType: MediaTypeManifest, Digest: tamperedDigest, Platform: &other},
+		{MediaType: MediaTypeManifest, Digest: index.Manifests[0].Digest, Platform: &platform},
+	}})
+	if err != nil {
+		t.Fatalf("Couldn't encode test index: %s", err)
+	}
+
+	tokens := 0
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if r.URL.Query().Get("scope") != "repository:team/base:pull" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			tokens++
+			fmt.Fprint(w, `{"token": "secret"}`)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/v2/team/base/")
+		switch {
+		case path == "manifests/1.2":
+			w.Header().Set("Content-Type", MediaTypeIndex)
+			w.Write(tagged)
+		case strings.HasSuffix(path, strings.TrimPrefix(tamperedDigest, "sha256:")):
+			w.Write([]byte("tampered"))
+		case strings.HasPrefix(path, "manifests/sha256:"), strings.HasPrefix(path, "blobs/sha256:"):
+			data, err := ioutil.ReadFile(filepath.Join(testLayout, "blobs/sha256", path[strings.Index(path, ":")+1:]))
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server, &tokens
+}
+
+func TestRegistryPull(t *testing.T) {
+
+	server, tokens := testRegistry(t)
+	defer server.Close()
+
+	r := &Registry{Client: server.Client()}
+	ref, err := ParseReference(strings.TrimPrefix(server.URL, "https://") + "/team/base:1.2")
+	if err != nil {
+		t.Fatalf("Error parsing test reference: %s", err)
+	}
+
+	manifest, err := r.Manifest(context.Background(), ref)
+	if err != nil {
+		t.Fatalf("Error getting manifest for %s: %s", ref, err)
+	}
+	if len(manifest.Layers) != 2 {
+		t.Fatalf("Manifest for %s has %d layers but expected 2", ref, len(manifest.Layers))
+	}
+
+	for _, d := range append(manifest.Layers, Descriptor{Digest: tamperedDigest}) {
+		blob, err := r.OpenBlob(context.Background(), ref, d)
+		if err != nil {
+			t.Errorf("Error opening blob %s: %s", d.Digest, err)
+			continue
+		}
+		_, err = ioutil.ReadAll(blob)
+		blob.Close()
+
+		_, mismatch := err.(*verify.DigestMismatchError)
+		if tampered := d.Digest == tamperedDigest; tampered != mismatch {
+			t.Errorf("Reading blob %s returned %v", d.Digest, err)
+		}
+	}
+
+	// the token is requested once for the repository
+	if *tokens != 1 {
+		t.Errorf("Registry requested %d tokens but expected 1", *tokens)
+	}
+
+	// other platforms select the bogus manifest, which doesn't match its digest
+	r.Platform = &Platform{OS: "plan9", Architecture: DefaultPlatform().Architecture}
+	if _, err = r.Manifest(context.Background(), ref); err == nil {
+		t.Errorf("Getting tampered manifest for %s should have failed, but did not", ref)
+	}
+
+	// shared registries don't keep the default client, the test certificate is not trusted by it
+	shared := &Registry{}
+	if _, err = shared.Manifest(context.Background(), ref); err == nil || shared.Client != nil {
+		t.Errorf("Default client pull returned %v and set client %v", err, shared.Client)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+
+	scheme, params := parseChallenge(`Bearer realm="https://auth.test/token",service="registry.test",scope="repository:team/base:pull"`)
+	if scheme != "Bearer" || params["realm"] != "https://auth.test/token" || params["service"] != "registry.test" || params["scope"] != "repository:team/base:pull" {
+		t.Errorf("Challenge parsed as %q %+v", scheme, params)
+	}
+}
@@ -0,0 +1,93 @@
+// Package oci reads container images in OCI and docker formats.
+package oci
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Media types of image manifests and indexes
+const (
+	MediaTypeManifest       = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeIndex          = "application/vnd.oci.image.index.v1+json"
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// AnnotationRefName is the annotation naming manifests in an image layout index
+const AnnotationRefName = "org.opencontainers.image.ref.name"
+
+// Platform is the operating system and architecture an image runs on
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Descriptor references contents by digest
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+// Manifest describes an image configuration and layers
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// Index references manifests, usually one per platform
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// DefaultPlatform returns the platform of the running process
+func DefaultPlatform() Platform {
+	return Platform{Architecture: runtime.GOARCH, OS: runtime.GOOS}
+}
+
+// IsIndex reports whether a media type is an index or manifest list
+func IsIndex(mediaType string) bool {
+	return mediaType == MediaTypeIndex || mediaType == MediaTypeDockerList
+}
+
+// SelectManifest returns the manifest in an index named ref and matching platform
+// An empty ref matches any name. Descriptors without platform match any platform.
+func SelectManifest(index *Index, ref string, platform Platform) (Descriptor, error) {
+	for _, d := range index.Manifests {
+		if ref != "" && d.Annotations[AnnotationRefName] != ref {
+			continue
+		}
+		if d.Platform != nil && !d.Platform.matches(platform) {
+			continue
+		}
+		return d, nil
+	}
+	if ref != "" {
+		return Descriptor{}, fmt.Errorf("No manifest named %q for platform %s", ref, platform)
+	}
+	return Descriptor{}, fmt.Errorf("No manifest for platform %s", platform)
+}
+
+// String returns the platform as os/architecture[/variant]
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// matches reports whether p runs on want, variants only count when both are set
+func (p Platform) matches(want Platform) bool {
+	if p.OS != want.OS || p.Architecture != want.Architecture {
+		return false
+	}
+	return p.Variant == "" || want.Variant == "" || p.Variant == want.Variant
+}
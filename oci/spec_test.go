@@ -0,0 +1,39 @@
+package oci
+
+import "testing"
+
+func TestSelectManifest(t *testing.T) {
+
+	index := &Index{Manifests: []Descriptor{
+		{Digest: "sha256:amd64", Platform: &Platform{OS: "linux", Architecture: "amd64"}, Annotations: map[string]string{AnnotationRefName: "latest"}},
+		{Digest: "sha256:armv7", Platform: &Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, Annotations: map[string]string{AnnotationRefName: "latest"}},
+		{Digest: "sha256:any", Annotations: map[string]string{AnnotationRefName: "stable"}},
+	}}
+
+	var testData = []struct {
+		ref      string   // reference looked up
+		platform Platform // platform looked up
+		digest   string   // expected manifest digest, empty if none should match
+	}{
+		{"latest", Platform{OS: "linux", Architecture: "amd64"}, "sha256:amd64"},
+		{"latest", Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, "sha256:armv7"},
+		{"latest", Platform{OS: "linux", Architecture: "arm"}, "sha256:armv7"},
+		{"latest", Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, ""},
+		{"stable", Platform{OS: "darwin", Architecture: "arm64"}, "sha256:any"},
+		{"", Platform{OS: "linux", Architecture: "s390x"}, "sha256:any"},
+		{"missing", Platform{OS: "linux", Architecture: "amd64"}, ""},
+	}
+
+	for _, td := range testData {
+		d, err := SelectManifest(index, td.ref, td.platform)
+		if err != nil {
+			if td.digest != "" {
+				t.Errorf("Error selecting %q for %s: %s", td.ref, td.platform, err)
+			}
+			continue
+		}
+		if d.Digest != td.digest {
+			t.Errorf("Selected %s for %q on %s but expected %q", d.Digest, td.ref, td.platform, td.digest)
+		}
+	}
+}
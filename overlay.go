@@ -0,0 +1,129 @@
+package fsisolate
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/odacremolbap/fsisolate/archive"
+)
+
+// overlay layout under its directory
+const (
+	overlayUpper  = "upper"
+	overlayWork   = "work"
+	overlayMerged = "merged"
+)
+
+// errOverlayUnsupported is returned when an overlay can't be mounted on the platform or with its directories
+var errOverlayUnsupported = errors.New("overlay mounts are not supported")
+
+// Overlay is a copy-on-write root combining a read-only image directory with a writable upper layer
+// When overlay mounts are permitted, lower and upper are mounted with overlayfs at the merged
+// directory. Otherwise the image is copied to the merged directory, which is then the upper layer too.
+// Only Dir is needed to discard or capture an overlay, so Overlay{Dir: dir} can be used
+// for overlays created by an earlier run.
+type Overlay struct {
+	Lower string // image directory, never modified
+	Dir   string // directory holding the upper layer, the overlayfs work directory and the merged root
+}
+
+// NewOverlay creates a copy-on-write root for the image directory lower at dir
+// dir must not exist or be empty. Images are only copied when overlay mounts are not permitted
+// or not supported, other mount errors are returned.
+func NewOverlay(lower, dir string) (*Overlay, error) {
+	lower, err := filepath.Abs(lower)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(lower); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("Error creating overlay: image %q is not a directory", lower)
+	}
+
+	// an existing overlay or other files would be mixed with the new root
+	items, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Error creating overlay: %s", err.Error())
+	}
+	if len(items) != 0 {
+		return nil, fmt.Errorf("Error creating overlay: directory %q is not empty", dir)
+	}
+
+	o := &Overlay{Lower: lower, Dir: dir}
+	for _, d := range []string{overlayUpper, overlayWork, overlayMerged} {
+		if err = os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, fmt.Errorf("Error creating overlay: %s", err.Error())
+		}
+	}
+
+	if err = mountOverlay(lower, o.upper(), filepath.Join(dir, overlayWork), o.Root()); err == nil {
+		return o, nil
+	}
+	if !overlayUnsupported(err) {
+		for _, d := range []string{overlayUpper, overlayWork, overlayMerged} {
+			os.Remove(filepath.Join(dir, d))
+		}
+		return nil, fmt.Errorf("Error mounting overlay: %s", err.Error())
+	}
+
+	// overlay mounts not permitted, fall back to a private copy of the image
+	os.Remove(o.upper())
+	os.Remove(filepath.Join(dir, overlayWork))
+	if err = copyTree(lower, o.Root(), copyFile); err != nil {
+		os.RemoveAll(o.Root())
+		return nil, fmt.Errorf("Error creating overlay: %s", err.Error())
+	}
+	return o, nil
+}
+
+// Root returns the directory to use as the process root
+func (o *Overlay) Root() string {
+	return filepath.Join(o.Dir, overlayMerged)
+}
+
+// Mounted reports whether the root is an overlayfs mount, false if it is a copy of the image
+func (o *Overlay) Mounted() bool {
+	return archive.IsMountPoint(o.Root(), o.Dir)
+}
+
+// upper returns the directory holding the upper layer
+func (o *Overlay) upper() string {
+	if _, err := os.Stat(filepath.Join(o.Dir, overlayUpper)); err != nil {
+		return o.Root()
+	}
+	return filepath.Join(o.Dir, overlayUpper)
+}
+
+// Discard unmounts the root and removes the overlay with the changes made to the image
+func (o *Overlay) Discard() error {
+	if err := o.unmount(); err != nil {
+		return err
+	}
+	return os.RemoveAll(o.Dir)
+}
+
+// Capture unmounts the root and moves the upper layer to dst, removing the rest of the overlay
+// A mounted overlay upper layer holds the files changed, with deleted files as overlayfs
+// whiteouts (0/0 character devices). A copied overlay upper layer is the whole modified root.
+func (o *Overlay) Capture(dst string) error {
+	if err := o.unmount(); err != nil {
+		return err
+	}
+	if err := os.Rename(o.upper(), dst); err != nil {
+		return fmt.Errorf("Error capturing overlay: %s", err.Error())
+	}
+	return os.RemoveAll(o.Dir)
+}
+
+// unmount unmounts the root if it is mounted
+func (o *Overlay) unmount() error {
+	if !o.Mounted() {
+		return nil
+	}
+	if err := unmountOverlay(o.Root()); err != nil {
+		return fmt.Errorf("Error unmounting overlay: %s", err.Error())
+	}
+	return nil
+}
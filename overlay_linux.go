@@ -0,0 +1,38 @@
+package fsisolate
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountOverlay mounts lower and upper directories with overlayfs at merged
+func mountOverlay(lower, upper, work, merged string) error {
+	// commas and colons separate mount options and lower directories
+	for _, d := range []string{lower, upper, work} {
+		if strings.ContainsAny(d, ",:") {
+			return errOverlayUnsupported
+		}
+	}
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	return unix.Mount("overlay", merged, "overlay", 0, options)
+}
+
+// overlayUnsupported reports whether a mount error means overlays can't be used here,
+// either not permitted or not available. Other errors, such as invalid options or directories
+// on filesystems that can't hold them, are returned to the caller.
+func overlayUnsupported(err error) bool {
+	for _, e := range []error{errOverlayUnsupported, unix.EPERM, unix.EACCES, unix.ENODEV} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// unmountOverlay unmounts an overlay root
+func unmountOverlay(merged string) error {
+	return unix.Unmount(merged, 0)
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package fsisolate
+
+import "fmt"
+
+// mountOverlay fails, overlayfs is only available on linux
+func mountOverlay(lower, upper, work, merged string) error {
+	return errOverlayUnsupported
+}
+
+// overlayUnsupported reports whether a mount error means overlays can't be used here
+func overlayUnsupported(err error) bool {
+	return err == errOverlayUnsupported
+}
+
+// unmountOverlay fails, overlayfs is only available on linux
+func unmountOverlay(merged string) error {
+	return fmt.Errorf("overlay mounts are not supported on this platform")
+}
@@ -0,0 +1,190 @@
+package fsisolate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/odacremolbap/fsisolate/archive"
+	"golang.org/x/sys/unix"
+)
+
+// lowerImage creates an image directory to be used as overlay lower layer
+func lowerImage(t *testing.T, dir string) {
+	os.MkdirAll(filepath.Join(dir, "etc"), 0755)
+	os.MkdirAll(filepath.Join(dir, "bin"), 0750)
+	if err := ioutil.WriteFile(filepath.Join(dir, "etc/hostname"), []byte("lower\n"), 0644); err != nil {
+		t.Fatalf("Couldn't create lower image: %s", err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "etc/motd"), []byte("hello\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "bin/tool"), []byte("#!/bin/tool\n"), 0755)
+	os.Chmod(filepath.Join(dir, "bin/tool"), 0755|os.ModeSetuid)
+	os.Link(filepath.Join(dir, "bin/tool"), filepath.Join(dir, "bin/alias"))
+	os.Symlink("../etc/hostname", filepath.Join(dir, "bin/hostname"))
+}
+
+func TestCopyTree(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	lowerImage(t, src)
+	if err = unix.Mkfifo(filepath.Join(src, "etc/fifo"), 0600); err != nil {
+		t.Fatalf("Couldn't create fifo: %s", err)
+	}
+	// device nodes and trusted attributes need privileges, user attributes filesystem support
+	devices := archive.MakeDevice(filepath.Join(src, "etc/null"), os.ModeDevice|os.ModeCharDevice|0666, 1, 3, archive.FailDevice) == nil
+	os.Chmod(filepath.Join(src, "etc/null"), os.ModeDevice|os.ModeCharDevice|0666)
+	xattrs := unix.Lsetxattr(filepath.Join(src, "etc/hostname"), "user.fsisolate", []byte("lower"), 0) == nil
+
+	if err = copyTree(src, dst, copyFile); err != nil {
+		t.Fatalf("Error copying tree: %s", err)
+	}
+
+	var testData = []struct {
+		path string      // copied path
+		mode os.FileMode // expected mode
+	}{
+		{"etc", os.ModeDir | 0755},
+		{"bin", os.ModeDir | 0750},
+		{"etc/hostname", 0644},
+		{"etc/motd", 0600},
+		{"bin/tool", 0755 | os.ModeSetuid},
+		{"bin/hostname", os.ModeSymlink | 0777},
+		{"etc/fifo", os.ModeNamedPipe | 0600},
+		{"etc/null", os.ModeDevice | os.ModeCharDevice | 0666},
+	}
+
+	for _, td := range testData {
+		if td.path == "etc/null" && !devices {
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(dst, td.path))
+		if err != nil {
+			t.Errorf("Copied %q can't be read: %s", td.path, err)
+			continue
+		}
+		if fi.Mode() != td.mode {
+			t.Errorf("Copied %q mode is %s but expected %s", td.path, fi.Mode(), td.mode)
+		}
+	}
+
+	if content, err := ioutil.ReadFile(filepath.Join(dst, "bin/hostname")); err != nil || string(content) != "lower\n" {
+		t.Errorf("Copied symlink points to %q (%v)", content, err)
+	}
+
+	tool, err1 := os.Stat(filepath.Join(dst, "bin/tool"))
+	alias, err2 := os.Stat(filepath.Join(dst, "bin/alias"))
+	if err1 != nil || err2 != nil || tool.Sys().(*syscall.Stat_t).Ino != alias.Sys().(*syscall.Stat_t).Ino {
+		t.Errorf("Copied hardlinks are not the same file")
+	}
+
+	if xattrs {
+		value := make([]byte, 16)
+		n, err := unix.Lgetxattr(filepath.Join(dst, "etc/hostname"), "user.fsisolate", value)
+		if err != nil {
+			t.Errorf("Copied extended attribute can't be read: %s", err)
+		} else if string(value[:n]) != "lower" {
+			t.Errorf("Copied extended attribute is %q but expected %q", value[:n], "lower")
+		}
+	}
+}
+
+func TestOverlay(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// only mounts that can't be made anywhere fall back to copies, invalid ones fail
+	if !overlayUnsupported(errOverlayUnsupported) || overlayUnsupported(unix.EINVAL) {
+		t.Errorf("Overlay mount errors taken as unsupported: %t for %v, %t for %v", overlayUnsupported(errOverlayUnsupported),
+			errOverlayUnsupported, overlayUnsupported(unix.EINVAL), unix.EINVAL)
+	}
+
+	// commas can't be used in overlayfs mount options, forcing the copy fallback
+	var testData = []struct {
+		lower   string // lower directory name
+		capture bool   // whether the upper layer is captured or discarded
+	}{
+		{"lower", false},
+		{"lower", true},
+		{"lower,copied", false},
+		{"lower,copied", true},
+	}
+
+	for _, td := range testData {
+
+		lower := filepath.Join(dir, td.lower)
+		if _, err := os.Stat(lower); err != nil {
+			lowerImage(t, lower)
+		}
+
+		o, err := NewOverlay(lower, filepath.Join(dir, "overlay"))
+		if err != nil {
+			t.Fatalf("Error creating overlay for %q: %s", td.lower, err)
+		}
+		if o.Mounted() && td.lower != "lower" {
+			t.Errorf("Overlay for %q was mounted", td.lower)
+		}
+
+		// overlays are not created over existing ones
+		if _, err = NewOverlay(lower, o.Dir); err == nil {
+			t.Errorf("Creating overlay for %q over an existing one should have failed, but did not", td.lower)
+		}
+
+		// a process changing the root
+		root := o.Root()
+		ioutil.WriteFile(filepath.Join(root, "etc/hostname"), []byte("upper\n"), 0644)
+		ioutil.WriteFile(filepath.Join(root, "etc/new"), []byte("new\n"), 0644)
+		os.Remove(filepath.Join(root, "etc/motd"))
+
+		if content, err := ioutil.ReadFile(filepath.Join(root, "bin/tool")); err != nil || string(content) != "#!/bin/tool\n" {
+			t.Errorf("Overlay root bin/tool contains %q (%v)", content, err)
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(lower, "etc/hostname")); err != nil || string(content) != "lower\n" {
+			t.Errorf("Lower etc/hostname was changed to %q (%v)", content, err)
+		}
+		if _, err := os.Stat(filepath.Join(lower, "etc/motd")); err != nil {
+			t.Errorf("Lower etc/motd was removed: %s", err)
+		}
+		if _, err := os.Stat(filepath.Join(lower, "etc/new")); err == nil {
+			t.Errorf("Lower etc/new was created")
+		}
+
+		if !td.capture {
+			if err = o.Discard(); err != nil {
+				t.Errorf("Error discarding overlay: %s", err)
+			}
+			if _, err = os.Stat(o.Dir); !os.IsNotExist(err) {
+				t.Errorf("Discarded overlay still exists (%v)", err)
+			}
+			continue
+		}
+
+		// captured with only the directory, as a later run would
+		captured := filepath.Join(dir, "captured")
+		os.RemoveAll(captured)
+		if err = (&Overlay{Dir: o.Dir}).Capture(captured); err != nil {
+			t.Errorf("Error capturing overlay: %s", err)
+			continue
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(captured, "etc/new")); err != nil || string(content) != "new\n" {
+			t.Errorf("Captured etc/new contains %q (%v)", content, err)
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(captured, "etc/hostname")); err != nil || string(content) != "upper\n" {
+			t.Errorf("Captured etc/hostname contains %q (%v)", content, err)
+		}
+		if _, err = os.Stat(o.Dir); !os.IsNotExist(err) {
+			t.Errorf("Captured overlay still exists (%v)", err)
+		}
+	}
+}
@@ -1,9 +1,15 @@
 package fsisolate
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
+
+	"github.com/odacremolbap/fsisolate/oci"
 )
 
 // PathType path format type
@@ -15,8 +21,67 @@ const (
 	urlPath
 	directoryPath
 	filePath
+	sourcePath
 )
 
+// Layer is an archive extracted as part of an image
+type Layer struct {
+	Name string                                           // layer name for error messages
+	Open func(ctx context.Context) (io.ReadCloser, error) // opens the layer contents, verified by the source
+}
+
+// ResolvedImage is an image found by a source resolver
+// Either Path replaces the image path, pointing to a local directory or archive file,
+// or the image is made of Layers extracted in order, along with its Config if known.
+type ResolvedImage struct {
+	Path   string
+	Layers []Layer
+	Config *oci.ImageConfig
+}
+
+// SourceResolver finds the image referenced by a path with the scheme it's registered for
+type SourceResolver func(ctx context.Context, path string) (*ResolvedImage, error)
+
+// sources are the registered source resolvers by scheme
+var sources = struct {
+	sync.RWMutex
+	resolvers map[string]SourceResolver
+}{resolvers: map[string]SourceResolver{}}
+
+// RegisterSource makes image paths starting with "scheme:" be resolved by resolve
+// unless a local file or directory with that name exists.
+// Registering a scheme again replaces its resolver.
+func RegisterSource(scheme string, resolve SourceResolver) {
+	sources.Lock()
+	defer sources.Unlock()
+	sources.resolvers[scheme] = resolve
+}
+
+// sourceResolver returns the resolver for a path scheme, nil if none is registered
+func sourceResolver(path string) SourceResolver {
+	i := strings.Index(path, ":")
+	if i <= 0 {
+		return nil
+	}
+
+	sources.RLock()
+	defer sources.RUnlock()
+	return sources.resolvers[path[:i]]
+}
+
+// resolveSource resolves a path with a registered scheme
+func resolveSource(ctx context.Context, path string) (*ResolvedImage, error) {
+	resolve := sourceResolver(path)
+	if resolve == nil {
+		return nil, fmt.Errorf("Cannot prepare image: no source registered for %q", path)
+	}
+	img, err := resolve(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot prepare image: error resolving %q: %s", path, err.Error())
+	}
+	return img, nil
+}
+
 // GetPathType returns the path type based on a path string
 func getPathType(path string) (pathType, error) {
 
@@ -26,9 +91,13 @@ func getPathType(path string) (pathType, error) {
 		return urlPath, nil
 	}
 
-	// check file or directory
+	// check file or directory, existing local paths are never taken for source references
 	r, err := os.Stat(path)
 	if err != nil {
+		// schemes with a registered source resolver
+		if sourceResolver(path) != nil {
+			return sourcePath, nil
+		}
 		return unknownPath, fmt.Errorf("Error checking path type: %s", err.Error())
 	}
 
@@ -2,6 +2,7 @@ package fsisolate
 
 import (
 	"fmt"
+	"io/ioutil"
 	"testing"
 )
 
@@ -17,6 +18,10 @@ func TestGetPathType(t *testing.T) {
 		{"https://secure.url.path", urlPath, true},
 		{"./path_test.go", filePath, true},
 		{"*?<notapath", unknownPath, false},
+		{"file:///", sourcePath, true},
+		{"oci-layout:testdata/oci-layout", sourcePath, true},
+		{"docker-archive:testdata/docker-archive.tar:busybox", sourcePath, true},
+		{"unregistered:testdata", unknownPath, false},
 	}
 
 	for _, td := range testData {
@@ -42,13 +47,22 @@ func TestGetPathType(t *testing.T) {
 		}
 	}
 
+	// existing local files are not taken for source references
+	t.Chdir(t.TempDir())
+	local := "oci-layout:fsisolate-test.tar"
+	if err := ioutil.WriteFile(local, nil, 0644); err != nil {
+		t.Fatalf("Couldn't create local file %q: %s", local, err)
+	}
+	if pt, err := getPathType(local); err != nil || pt != filePath {
+		t.Errorf("Expected pathtype for %q was %q but received %q (%v)", local, filePath, pt, err)
+	}
 }
 
 // generated by stringer --type=pathType; DO NOT EDIT.
 // too late, I edited it
-const _pathTypeName = "unknownPathurlPathdirectoryPathfilePath"
+const _pathTypeName = "unknownPathurlPathdirectoryPathfilePathsourcePath"
 
-var _pathTypeIndex = [...]uint8{0, 11, 18, 31, 39}
+var _pathTypeIndex = [...]uint8{0, 11, 18, 31, 39, 49}
 
 func (i pathType) String() string {
 	if i >= pathType(len(_pathTypeIndex)-1) {
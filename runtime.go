@@ -2,11 +2,14 @@ package fsisolate
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"sync"
 	"syscall"
+
+	"github.com/odacremolbap/fsisolate/oci"
 )
 
 // ProcessState is the state in which a process can be
@@ -26,12 +29,17 @@ const (
 // outputStream is accessed using a method
 // root shouldn't change, it can only be set on creation
 // cmd is set when the process is started.
+// ctx is the context the process was started with, done is closed once waited.
+// config holds the image defaults used by ExecImage.
 type ChrootedProcess struct {
 	sync.Mutex
 	outStream *os.File
 	root      string
 	cmd       *exec.Cmd
 	waited    bool
+	ctx       context.Context
+	done      chan struct{}
+	config    *oci.ImageConfig
 }
 
 // NewChrootProcess returns a chroot process structure
@@ -44,6 +52,11 @@ func NewChrootProcess(root string) *ChrootedProcess {
 	}
 }
 
+// SetConfig sets the image configuration used as defaults by ExecImage
+func (p *ChrootedProcess) SetConfig(config *oci.ImageConfig) {
+	p.config = config
+}
+
 // SetOutput sets output stream for sandboxed process
 func (p *ChrootedProcess) SetOutput(out *os.File) {
 	p.outStream = out
@@ -51,9 +64,15 @@ func (p *ChrootedProcess) SetOutput(out *os.File) {
 
 // Exec executes command in chroot sandbox
 func (p *ChrootedProcess) Exec(command string, args ...string) error {
+	return p.ExecContext(context.Background(), command, args...)
+}
+
+// ExecContext executes command in chroot sandbox, killing it when ctx is done
+// The process runs in its own process group so that the whole tree is killed.
+// Once killed, Wait returns the context error.
+func (p *ChrootedProcess) ExecContext(ctx context.Context, command string, args ...string) error {
 	p.Lock()
 	defer p.Unlock()
-	p.waited = false
 
 	if p.getState() == Running {
 		return fmt.Errorf("Error starting process: there is another process executing in this chroot")
@@ -66,7 +85,25 @@ func (p *ChrootedProcess) Exec(command string, args ...string) error {
 		chargs = append(chargs, arg)
 	}
 
-	p.cmd = exec.Command("chroot", chargs...)
+	return p.start(ctx, exec.Command("chroot", chargs...))
+}
+
+// start starts cmd as the chrooted process, killing it when ctx is done
+// The caller must hold the lock and check that no other process is running, whose state
+// depends on it being waited.
+func (p *ChrootedProcess) start(ctx context.Context, cmd *exec.Cmd) error {
+	p.cmd = cmd
+	p.waited = false
+	p.ctx = ctx
+	p.done = make(chan struct{})
+
+	// contexts that can't be cancelled keep the process in our group
+	if ctx.Done() != nil {
+		if p.cmd.SysProcAttr == nil {
+			p.cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		p.cmd.SysProcAttr.Setpgid = true
+	}
 
 	// get stdout from chrooted process
 	reader, err := p.cmd.StdoutPipe()
@@ -88,9 +125,22 @@ func (p *ChrootedProcess) Exec(command string, args ...string) error {
 	if err != nil {
 		return fmt.Errorf("Error starting process: %s", err.Error())
 	}
+
+	if ctx.Done() != nil {
+		go killOnDone(ctx, p.cmd.Process.Pid, p.done)
+	}
 	return nil
 }
 
+// killOnDone kills a process group when ctx is done, unless the process is waited first
+func killOnDone(ctx context.Context, pgid int, done chan struct{}) {
+	select {
+	case <-ctx.Done():
+		syscall.Kill(-pgid, syscall.SIGKILL)
+	case <-done:
+	}
+}
+
 // Wait waits for the execution to end
 func (p *ChrootedProcess) Wait() error {
 	p.Lock()
@@ -102,7 +152,11 @@ func (p *ChrootedProcess) Wait() error {
 
 	err := p.cmd.Wait()
 	p.waited = true
+	close(p.done)
 	if err != nil {
+		if p.ctx.Err() != nil {
+			return p.ctx.Err()
+		}
 		return fmt.Errorf("Error waiting process: %s", err.Error())
 	}
 	return nil
@@ -1,11 +1,16 @@
 package fsisolate
 
 import (
+	"context"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
 	"syscall"
 	"testing"
 	"time"
+
+	"github.com/odacremolbap/fsisolate/oci"
 )
 
 func TestExecute(t *testing.T) {
@@ -109,3 +114,134 @@ func TestSendSignal(t *testing.T) {
 
 	}
 }
+
+func TestExecContext(t *testing.T) {
+
+	p := NewChrootProcess("testdata/simple")
+	p.SetOutput(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := p.ExecContext(ctx, "/loop-"+runtime.GOOS, "-i=5"); err != nil {
+		t.Fatalf("Execution with context returned an error: %s", err)
+	}
+
+	if err := p.Wait(); err != context.DeadlineExceeded {
+		t.Errorf("Waiting for process with expired context returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Process with expired context was not killed, ran for %s", elapsed)
+	}
+	if state := p.GetState(); state != Killed {
+		t.Errorf("Process with expired context state is %q but expected %q", state, Killed)
+	}
+
+	// killed and waited processes don't keep the chroot busy
+	if err := p.ExecContext(context.Background(), "/loop-"+runtime.GOOS, "-i=0"); err != nil {
+		t.Fatalf("Execution after a killed process returned an error: %s", err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Errorf("Waiting for process after a killed one returned an error: %s", err)
+	}
+}
+
+func TestExecImage(t *testing.T) {
+
+	loop := "loop-" + runtime.GOOS
+	image := &oci.ImageConfig{Config: oci.ContainerConfig{
+		Entrypoint: []string{"/" + loop},
+		Cmd:        []string{"-e=3", "-i=1"},
+	}}
+
+	var testData = []struct {
+		config     *oci.ImageConfig // image configuration
+		exec       *ExecConfig      // overrides
+		execOK     bool             // whether start should return OK or error
+		exitStatus int              // expected exit status
+	}{
+		{image, nil, true, 3},
+		{image, &ExecConfig{Args: []string{"-i=1"}}, true, 0},
+		{image, &ExecConfig{Entrypoint: []string{"../" + loop, "-i=1"}, WorkingDir: "/bin"}, true, 0},
+		{image, &ExecConfig{Entrypoint: []string{loop, "-i=1"}, Env: []string{"PATH=/"}}, true, 0},
+		{image, &ExecConfig{Entrypoint: []string{loop}}, false, 0},
+		{image, &ExecConfig{User: "nobody"}, false, 0},
+		{nil, nil, false, 0},
+		{nil, &ExecConfig{Entrypoint: []string{"/" + loop}, Args: []string{"-e=2", "-i=1"}}, true, 2},
+	}
+
+	for _, td := range testData {
+
+		p := NewChrootProcess("testdata/simple")
+		p.SetOutput(nil)
+		p.SetConfig(td.config)
+
+		err := p.ExecImage(context.Background(), td.exec)
+		if err != nil {
+			if td.execOK {
+				t.Errorf("Execution of image with %+v returned an error: %s", td.exec, err)
+			}
+			continue
+		}
+		if !td.execOK {
+			t.Errorf("Execution of image with %+v should have failed, but did not", td.exec)
+		}
+
+		p.Wait()
+		st, err := p.GetExitStatus()
+		if err != nil {
+			t.Errorf("Getting exit status for image with %+v returned an unexpected error: %s", td.exec, err)
+			continue
+		}
+		if st != td.exitStatus {
+			t.Errorf("Exit status for image with %+v returned %d but expected %d", td.exec, st, td.exitStatus)
+		}
+	}
+}
+
+func TestLookupUser(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create root directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	os.Mkdir(filepath.Join(root, "etc"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "etc/passwd"), []byte("root:x:0:0:root:/root:/bin/sh\nnobody:x:65534:65533:nobody:/:/bin/false\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "etc/group"), []byte("root:x:0:\nwheel:x:10:root\n"), 0644)
+
+	var testData = []struct {
+		spec     string // user spec
+		uid, gid uint32 // expected credentials
+		lookupOK bool   // whether lookup should succeed
+	}{
+		{"root", 0, 0, true},
+		{"nobody", 65534, 65533, true},
+		{"65534", 65534, 65533, true},
+		{"1000", 1000, 0, true},
+		{"nobody:wheel", 65534, 10, true},
+		{"1000:20", 1000, 20, true},
+		{"daemon", 0, 0, false},
+		{"nobody:staff", 0, 0, false},
+	}
+
+	for _, td := range testData {
+
+		cred, err := lookupUser(root, td.spec)
+		if err != nil {
+			if td.lookupOK {
+				t.Errorf("Lookup of user %q returned an error: %s", td.spec, err)
+			}
+			continue
+		}
+		if !td.lookupOK {
+			t.Errorf("Lookup of user %q should have failed, but did not", td.spec)
+			continue
+		}
+		if cred.Uid != td.uid || cred.Gid != td.gid {
+			t.Errorf("User %q resolved to %d:%d but expected %d:%d", td.spec, cred.Uid, cred.Gid, td.uid, td.gid)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package fsisolate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/odacremolbap/fsisolate/archive"
+)
+
+// snapshot layout under its directory
+const (
+	snapshotRoot   = "root"
+	snapshotRecord = "snapshot.json"
+	snapshotsExt   = ".snapshots"
+)
+
+// SnapshotMode is how snapshot files are stored
+type SnapshotMode string
+
+// Possible snapshot modes
+const (
+	SnapshotCopy     SnapshotMode = "copy"     // files are copied, as reflinks when the filesystem supports them
+	SnapshotHardlink SnapshotMode = "hardlink" // files are hardlinked, only safe if files are replaced instead of written in place
+)
+
+// Snapshot describes a snapshot of a root
+type Snapshot struct {
+	Name    string       `json:"name"`
+	Created time.Time    `json:"created"`
+	Mode    SnapshotMode `json:"mode"`
+}
+
+// Snapshots manages named snapshots of a prepared root
+// With SnapshotHardlink, snapshots and restored roots share their files, so a process writing
+// a file in place instead of replacing it changes the snapshot too. Hardlinks that can't be
+// made across filesystems are copied.
+type Snapshots struct {
+	Root string       // root directory, as returned by Image.Prepare
+	Dir  string       // directory holding the snapshots, defaults to Root plus ".snapshots"
+	Mode SnapshotMode // how new snapshots are stored, defaults to SnapshotCopy
+}
+
+// Take takes a named snapshot of the root
+// Names can't contain path separators nor start with a dot. Existing snapshots are not replaced.
+func (s *Snapshots) Take(name string) (*Snapshot, error) {
+	if err := validSnapshotName(name); err != nil {
+		return nil, err
+	}
+
+	dir := s.dir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Error taking snapshot: %s", err.Error())
+	}
+	if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+		return nil, fmt.Errorf("Error taking snapshot: snapshot %q already exists", name)
+	}
+
+	mode := s.Mode
+	if mode == "" {
+		mode = SnapshotCopy
+	}
+	file := copyFile
+	if mode == SnapshotHardlink {
+		file = linkFile
+	}
+
+	// taken in a hidden directory, so that half taken snapshots are never listed
+	tmp, err := ioutil.TempDir(dir, ".take")
+	if err != nil {
+		return nil, fmt.Errorf("Error taking snapshot: %s", err.Error())
+	}
+	snapshot := &Snapshot{Name: name, Created: time.Now().UTC(), Mode: mode}
+	if err = s.take(tmp, snapshot, file); err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("Error taking snapshot: %s", err.Error())
+	}
+	if err = os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("Error taking snapshot: %s", err.Error())
+	}
+	return snapshot, nil
+}
+
+// take copies the root and writes the snapshot record to dir
+func (s *Snapshots) take(dir string, snapshot *Snapshot, file copyFunc) error {
+	if err := copyTree(s.Root, filepath.Join(dir, snapshotRoot), file); err != nil {
+		return err
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, snapshotRecord), data, 0644)
+}
+
+// List returns the snapshots of the root, oldest first
+func (s *Snapshots) List() ([]Snapshot, error) {
+	entries, err := ioutil.ReadDir(s.dir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var snapshots []Snapshot
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		snapshot, err := s.get(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, *snapshot)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.Before(snapshots[j].Created) })
+	return snapshots, nil
+}
+
+// get reads the record of a snapshot
+func (s *Snapshots) get(name string) (*Snapshot, error) {
+	if err := validSnapshotName(name); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.dir(), name, snapshotRecord))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("Error reading snapshot: snapshot %q not found", name)
+		}
+		return nil, err
+	}
+	snapshot := &Snapshot{}
+	if err = json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("Error reading snapshot %q: %s", name, err.Error())
+	}
+	return snapshot, nil
+}
+
+// Restore rolls the root back to a snapshot
+// The snapshot is copied next to the root and swapped in once complete, so a failed restore leaves
+// the root untouched. Mount point roots are kept, with their entries replaced.
+// The snapshot is kept and can be restored again.
+func (s *Snapshots) Restore(name string) error {
+	snapshot, err := s.get(name)
+	if err != nil {
+		return err
+	}
+	file := copyFile
+	if snapshot.Mode == SnapshotHardlink {
+		file = linkFile
+	}
+
+	src := filepath.Join(s.dir(), name, snapshotRoot)
+	err = archive.ReplaceDir(context.Background(), s.Root, func(dir string) error {
+		return copyTree(src, dir, file)
+	})
+	if err != nil {
+		return fmt.Errorf("Error restoring snapshot: %s", err.Error())
+	}
+	return nil
+}
+
+// Remove removes a snapshot
+func (s *Snapshots) Remove(name string) error {
+	if _, err := s.get(name); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(s.dir(), name))
+}
+
+// Diff returns the paths changed in the root since a snapshot was taken
+func (s *Snapshots) Diff(name string) ([]archive.Change, error) {
+	if _, err := s.get(name); err != nil {
+		return nil, err
+	}
+	return archive.Changes(filepath.Join(s.dir(), name, snapshotRoot), s.Root)
+}
+
+// dir returns the directory holding the snapshots
+func (s *Snapshots) dir() string {
+	if s.Dir != "" {
+		return s.Dir
+	}
+	return filepath.Clean(s.Root) + snapshotsExt
+}
+
+// validSnapshotName checks that a snapshot name can be used as a directory name
+func validSnapshotName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("Error using snapshot: invalid snapshot name %q", name)
+	}
+	return nil
+}
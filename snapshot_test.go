@@ -0,0 +1,121 @@
+package fsisolate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/odacremolbap/fsisolate/archive"
+	"golang.org/x/sys/unix"
+)
+
+func TestSnapshots(t *testing.T) {
+
+	var testData = []struct {
+		mode SnapshotMode // snapshot mode
+	}{
+		{""},
+		{SnapshotCopy},
+		{SnapshotHardlink},
+	}
+
+	for _, td := range testData {
+
+		dir, err := ioutil.TempDir("", "fsisolate")
+		if err != nil {
+			t.Fatalf("Couldn't create temporary directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		root := filepath.Join(dir, "root")
+		lowerImage(t, root)
+		if err = unix.Mkfifo(filepath.Join(root, "etc/fifo"), 0600); err != nil {
+			t.Fatalf("Couldn't create fifo: %s", err)
+		}
+
+		s := Snapshots{Root: root, Mode: td.mode}
+		if _, err = s.Take("clean"); err != nil {
+			t.Errorf("Error taking %q snapshot: %s", td.mode, err)
+			continue
+		}
+		if _, err = s.Take("clean"); err == nil {
+			t.Errorf("Taking %q snapshot with an existing name should have failed, but did not", td.mode)
+		}
+		if _, err = s.Take("../escape"); err == nil {
+			t.Errorf("Taking %q snapshot with an invalid name should have failed, but did not", td.mode)
+		}
+
+		// a job replacing, adding and removing files
+		os.Remove(filepath.Join(root, "etc/hostname"))
+		ioutil.WriteFile(filepath.Join(root, "etc/hostname"), []byte("job\n"), 0644)
+		ioutil.WriteFile(filepath.Join(root, "etc/job.log"), []byte("done\n"), 0644)
+		os.Remove(filepath.Join(root, "etc/motd"))
+
+		if _, err = s.Take("dirty"); err != nil {
+			t.Errorf("Error taking %q snapshot: %s", td.mode, err)
+		}
+
+		changes, err := s.Diff("clean")
+		if err != nil {
+			t.Errorf("Error getting %q snapshot diff: %s", td.mode, err)
+		}
+		expected := []archive.Change{
+			{Path: "/etc/hostname", Kind: archive.ChangeModified, Contents: true},
+			{Path: "/etc/job.log", Kind: archive.ChangeAdded},
+			{Path: "/etc/motd", Kind: archive.ChangeDeleted},
+		}
+		if len(changes) != len(expected) {
+			t.Errorf("Diff of %q snapshot is %+v but expected %+v", td.mode, changes, expected)
+		} else {
+			for i := range expected {
+				if changes[i] != expected[i] {
+					t.Errorf("Diff of %q snapshot is %+v but expected %+v", td.mode, changes, expected)
+					break
+				}
+			}
+		}
+
+		snapshots, err := s.List()
+		if err != nil || len(snapshots) != 2 || snapshots[0].Name != "clean" || snapshots[1].Name != "dirty" {
+			t.Errorf("Listed %q snapshots are %+v (%v)", td.mode, snapshots, err)
+		}
+
+		if err = s.Restore("clean"); err != nil {
+			t.Errorf("Error restoring %q snapshot: %s", td.mode, err)
+			continue
+		}
+		if changes, err = s.Diff("clean"); err != nil || len(changes) != 0 {
+			t.Errorf("Restored %q snapshot has changes %+v (%v)", td.mode, changes, err)
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(root, "etc/hostname")); err != nil || string(content) != "lower\n" {
+			t.Errorf("Restored %q snapshot etc/hostname contains %q (%v)", td.mode, content, err)
+		}
+		if fi, err := os.Stat(filepath.Join(root, "bin/tool")); err != nil || fi.Mode() != 0755|os.ModeSetuid {
+			t.Errorf("Restored %q snapshot bin/tool is %v (%v)", td.mode, fi, err)
+		}
+		if fi, err := os.Lstat(filepath.Join(root, "etc/fifo")); err != nil || fi.Mode() != os.ModeNamedPipe|0600 {
+			t.Errorf("Restored %q snapshot etc/fifo is %v (%v)", td.mode, fi, err)
+		}
+
+		// snapshots failing to be copied leave the root untouched
+		ioutil.WriteFile(filepath.Join(root, "etc/job.log"), []byte("again\n"), 0644)
+		if _, err = s.Take("broken"); err != nil {
+			t.Errorf("Error taking %q snapshot: %s", td.mode, err)
+		}
+		os.RemoveAll(filepath.Join(s.dir(), "broken", snapshotRoot))
+		if err = s.Restore("broken"); err == nil {
+			t.Errorf("Restoring broken %q snapshot should have failed, but did not", td.mode)
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(root, "etc/job.log")); err != nil || string(content) != "again\n" {
+			t.Errorf("Failed %q snapshot restore left etc/job.log with %q (%v)", td.mode, content, err)
+		}
+
+		if err = s.Remove("dirty"); err != nil {
+			t.Errorf("Error removing %q snapshot: %s", td.mode, err)
+		}
+		if err = s.Restore("dirty"); err == nil {
+			t.Errorf("Restoring removed %q snapshot should have failed, but did not", td.mode)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package fsisolate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/odacremolbap/fsisolate/oci"
+)
+
+// sources shipped with the library
+func init() {
+	RegisterSource("file", resolveFileURL)
+	RegisterSource("oci-layout", resolveOCILayout)
+	RegisterSource("docker-archive", resolveDockerArchive)
+	RegisterSource("docker", RegistrySource(&oci.Registry{}))
+}
+
+// resolveFileURL resolves file:// URLs to local files and directories
+func resolveFileURL(ctx context.Context, path string) (*ResolvedImage, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("file URL host %q is not local", u.Host)
+	}
+	if u.Path == "" {
+		return nil, fmt.Errorf("file URL has no path")
+	}
+	return &ResolvedImage{Path: u.Path}, nil
+}
+
+// resolveOCILayout resolves "oci-layout:<dir>[:<ref>]" references to an OCI image layout
+// The reference is the image name in the layout index, and can be omitted if there's only one.
+func resolveOCILayout(ctx context.Context, path string) (*ResolvedImage, error) {
+	dir, ref := splitReference(strings.TrimPrefix(path, "oci-layout:"))
+
+	layout, err := oci.OpenLayout(dir)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := layout.Manifest(ref, oci.DefaultPlatform())
+	if err != nil {
+		return nil, err
+	}
+	config, err := layout.Config(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &ResolvedImage{Config: config}
+	for _, d := range manifest.Layers {
+		d := d
+		img.Layers = append(img.Layers, Layer{
+			Name: d.Digest,
+			Open: func(ctx context.Context) (io.ReadCloser, error) {
+				return layout.OpenBlob(d)
+			},
+		})
+	}
+	return img, nil
+}
+
+// resolveDockerArchive resolves "docker-archive:<file>[:<repo:tag>]" references to a docker save archive
+// The reference is the image tag, and can be omitted if there's only one image.
+func resolveDockerArchive(ctx context.Context, path string) (*ResolvedImage, error) {
+	file, ref := splitReference(strings.TrimPrefix(path, "docker-archive:"))
+
+	archive, err := oci.OpenDockerArchive(file)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := archive.Manifest(ref)
+	if err != nil {
+		return nil, err
+	}
+	config, err := archive.Config(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &ResolvedImage{Config: config}
+	for _, name := range manifest.Layers {
+		name := name
+		img.Layers = append(img.Layers, Layer{
+			Name: name,
+			Open: func(ctx context.Context) (io.ReadCloser, error) {
+				return archive.Open(name)
+			},
+		})
+	}
+	return img, nil
+}
+
+// RegistrySource returns a resolver for "docker://<reference>" paths pulling from registries
+// Register it again with a configured registry to use credentials or a custom client:
+//
+//	RegisterSource("docker", RegistrySource(&oci.Registry{Username: "user", Password: "secret"}))
+func RegistrySource(registry *oci.Registry) SourceResolver {
+	return func(ctx context.Context, path string) (*ResolvedImage, error) {
+		ref, err := oci.ParseReference(strings.TrimPrefix(path[strings.Index(path, ":")+1:], "//"))
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := registry.Manifest(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		config, err := registry.Config(ctx, ref, manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		img := &ResolvedImage{Config: config}
+		for _, d := range manifest.Layers {
+			d := d
+			img.Layers = append(img.Layers, Layer{
+				Name: d.Digest,
+				Open: func(ctx context.Context) (io.ReadCloser, error) {
+					return registry.OpenBlob(ctx, ref, d)
+				},
+			})
+		}
+		return img, nil
+	}
+}
+
+// splitReference splits "<path>[:<ref>]" at the first colon that leaves an existing path
+// References can contain colons themselves, as in "busybox:latest".
+func splitReference(s string) (string, string) {
+	if _, err := os.Stat(s); err == nil {
+		return s, ""
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != ':' {
+			continue
+		}
+		if _, err := os.Stat(s[:i]); err == nil {
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
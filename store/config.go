@@ -0,0 +1,50 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/odacremolbap/fsisolate/oci"
+)
+
+// configRecord is the stored configuration of an image
+type configRecord struct {
+	Ref    string           `json:"ref"`
+	Config *oci.ImageConfig `json:"config"`
+}
+
+// SaveConfig keeps the configuration of the image at ref, replacing any previous one
+func (s *Store) SaveConfig(ref string, config *oci.ImageConfig) error {
+	// stores created before configs were kept lack the directory
+	if err := os.MkdirAll(filepath.Join(s.Dir, configsDir), 0755); err != nil {
+		return err
+	}
+	return s.writeJSON(s.configPath(ref), &configRecord{Ref: ref, Config: config})
+}
+
+// Config returns the configuration kept for the image at ref, nil if there's none
+func (s *Store) Config(ref string) (*oci.ImageConfig, error) {
+	data, err := ioutil.ReadFile(s.configPath(ref))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	record := &configRecord{}
+	if err = json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	return record.Config, nil
+}
+
+// configPath returns the path to the configuration record for an image
+func (s *Store) configPath(ref string) string {
+	sum := sha256.Sum256([]byte(ref))
+	return filepath.Join(s.Dir, configsDir, hex.EncodeToString(sum[:])+".json")
+}
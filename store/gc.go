@@ -0,0 +1,205 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/odacremolbap/fsisolate/verify"
+	"golang.org/x/sys/unix"
+)
+
+// gcLockFile serializes garbage collections between processes sharing a store
+const gcLockFile = "gc.lock"
+
+// ErrInUse is returned when removing an archive that is open
+var ErrInUse = errors.New("Stored archive is in use")
+
+// Entry is an archive kept in the store
+type Entry struct {
+	Digest   verify.Digest
+	Size     int64
+	LastUsed time.Time
+	URLs     []string // URLs the archive was downloaded from
+}
+
+// Open opens a stored archive for reading and marks it as used
+// While the file is open the archive is not removed by Remove or GC. Archives not stored,
+// or removed before being locked, return an error for which os.IsNotExist is true.
+// Use is only recorded in stores that can be written, read-only stores are still usable.
+func (s *Store) Open(digest verify.Digest) (*os.File, error) {
+	file, err := os.Open(s.BlobPath(digest))
+	if err != nil {
+		return nil, err
+	}
+
+	// shared lock, removal needs an exclusive one
+	if err = unix.Flock(int(file.Fd()), unix.LOCK_SH); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// removed between opening and locking
+	var st unix.Stat_t
+	if err = unix.Fstat(int(file.Fd()), &st); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if st.Nlink == 0 {
+		file.Close()
+		return nil, &os.PathError{Op: "open", Path: file.Name(), Err: syscall.ENOENT}
+	}
+
+	// archives never change, so modification time records their last use
+	now := time.Now()
+	os.Chtimes(file.Name(), now, now)
+	return file, nil
+}
+
+// Entries returns the archives kept in the store
+func (s *Store) Entries() ([]Entry, error) {
+	dir := filepath.Join(s.Dir, blobsDir, verify.SHA256)
+	items, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	urls, err := s.sourceURLs()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(items))
+	for _, fi := range items {
+		digest := verify.Digest{Algorithm: verify.SHA256, Hex: fi.Name()}
+		entries = append(entries, Entry{
+			Digest:   digest,
+			Size:     fi.Size(),
+			LastUsed: fi.ModTime(),
+			URLs:     urls[digest.String()],
+		})
+	}
+	return entries, nil
+}
+
+// Remove removes an archive from the store
+// ErrInUse is returned if the archive is open.
+func (s *Store) Remove(digest verify.Digest) error {
+	file, err := os.Open(s.BlobPath(digest))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return ErrInUse
+		}
+		return err
+	}
+	return os.Remove(file.Name())
+}
+
+// GC removes least recently used archives until the store size is within budget
+// Archives in use are skipped. Removed entries are returned.
+func (s *Store) GC(budget int64) ([]Entry, error) {
+	lock, err := os.OpenFile(filepath.Join(s.Dir, gcLockFile), os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	if err = unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return nil, err
+	}
+
+	entries, err := s.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	var size int64
+	for _, e := range entries {
+		size += e.Size
+	}
+
+	// least recently used first
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+
+	var removed []Entry
+	for _, e := range entries {
+		if size <= budget {
+			break
+		}
+		err := s.Remove(e.Digest)
+		if err == ErrInUse || os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		size -= e.Size
+		removed = append(removed, e)
+	}
+
+	return removed, s.removeStaleSources()
+}
+
+// sourceURLs returns the URLs recorded for each archive digest
+func (s *Store) sourceURLs() (map[string][]string, error) {
+	urls := map[string][]string{}
+	err := s.walkSources(func(path string, src *Source) error {
+		urls[src.Digest] = append(urls[src.Digest], src.URL)
+		return nil
+	})
+	return urls, err
+}
+
+// removeStaleSources removes records for archives no longer stored
+func (s *Store) removeStaleSources() error {
+	return s.walkSources(func(path string, src *Source) error {
+		digest, err := verify.ParseDigest(src.Digest)
+		if err == nil && s.HasBlob(digest) {
+			return nil
+		}
+		if err = os.Remove(path); os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// walkSources calls fn for every source record
+func (s *Store) walkSources(fn func(path string, src *Source) error) error {
+	dir := filepath.Join(s.Dir, sourcesDir)
+	items, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range items {
+		path := filepath.Join(dir, fi.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		src := &Source{}
+		if err = json.Unmarshal(data, src); err != nil {
+			continue
+		}
+		if err = fn(path, src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
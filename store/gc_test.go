@@ -0,0 +1,113 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/odacremolbap/fsisolate/verify"
+)
+
+// storeBlob commits contents to the store and sets their last use
+func storeBlob(t *testing.T, s *Store, contents, url string, lastUsed time.Time) verify.Digest {
+	w, err := s.Create()
+	if err != nil {
+		t.Fatalf("Couldn't create store writer: %s", err)
+	}
+	w.Write([]byte(contents))
+	digest, err := w.Commit(&Source{URL: url})
+	if err != nil {
+		t.Fatalf("Error committing store writer: %s", err)
+	}
+	if err = os.Chtimes(s.BlobPath(digest), lastUsed, lastUsed); err != nil {
+		t.Fatalf("Couldn't set last use for %s: %s", digest, err)
+	}
+	return digest
+}
+
+func TestStoreGC(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create store directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir)
+	if err != nil {
+		t.Fatalf("Couldn't create store: %s", err)
+	}
+
+	now := time.Now()
+	oldest := storeBlob(t, s, "oldest contents", "http://test.url/oldest", now.Add(-3*time.Hour))
+	old := storeBlob(t, s, "old contents", "http://test.url/old", now.Add(-2*time.Hour))
+	recent := storeBlob(t, s, "recent contents", "http://test.url/recent", now.Add(-1*time.Hour))
+
+	entries, err := s.Entries()
+	if err != nil {
+		t.Fatalf("Error listing store entries: %s", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Store listed %d entries but expected 3", len(entries))
+	}
+	for _, e := range entries {
+		if e.Digest == old && (e.Size != int64(len("old contents")) || len(e.URLs) != 1 || e.URLs[0] != "http://test.url/old") {
+			t.Errorf("Store entry for %s listed as %+v", old, e)
+		}
+	}
+
+	// the oldest archive is in use, so the old one goes instead
+	file, err := s.Open(oldest)
+	if err != nil {
+		t.Fatalf("Couldn't open stored archive: %s", err)
+	}
+	if err = s.Remove(oldest); err != ErrInUse {
+		t.Errorf("Removing an archive in use returned %v", err)
+	}
+
+	removed, err := s.GC(int64(len("oldest contents") + len("recent contents")))
+	if err != nil {
+		t.Fatalf("Error collecting store: %s", err)
+	}
+	if len(removed) != 1 || removed[0].Digest != old {
+		t.Errorf("Collection removed %+v but expected %s", removed, old)
+	}
+
+	// opening marked the oldest archive as recently used
+	file.Close()
+	removed, err = s.GC(int64(len("oldest contents")))
+	if err != nil {
+		t.Fatalf("Error collecting store: %s", err)
+	}
+	if len(removed) != 1 || removed[0].Digest != recent {
+		t.Errorf("Collection removed %+v but expected %s", removed, recent)
+	}
+
+	if err = s.Remove(oldest); err != nil {
+		t.Errorf("Error removing archive: %s", err)
+	}
+
+	// collected archives are not stored anymore
+	if file, err = s.Open(old); !os.IsNotExist(err) {
+		t.Errorf("Opening a collected archive returned %v (%v)", file, err)
+	}
+
+	// records for collected archives are removed too
+	items, err := ioutil.ReadDir(dir + "/" + sourcesDir)
+	if err != nil || len(items) != 1 {
+		t.Errorf("Store kept %d source records (%v) but expected 1", len(items), err)
+	}
+
+	// committed archives are kept by their own collection, older ones are not
+	s.MaxSize = 1
+	committed := storeBlob(t, s, "committed contents", "http://test.url/committed", now)
+	if file, err = s.Open(committed); err != nil {
+		t.Errorf("Couldn't open archive committed over the store budget: %s", err)
+	} else {
+		file.Close()
+	}
+	if entries, err = s.Entries(); err != nil || len(entries) != 1 {
+		t.Errorf("Store kept %+v (%v) but expected only %s", entries, err, committed)
+	}
+}
@@ -0,0 +1,188 @@
+// Package store implements a local content addressed cache for images.
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/odacremolbap/fsisolate/verify"
+)
+
+// store layout under its directory
+const (
+	blobsDir   = "blobs"
+	sourcesDir = "sources"
+	tmpDir     = "tmp"
+	configsDir = "configs"
+)
+
+// Store is a content addressed cache of image archives
+// Archives are kept by their sha256 digest. URLs they were downloaded from are recorded
+// along with their HTTP validators, so that cached archives can be revalidated.
+type Store struct {
+	Dir     string
+	MaxSize int64 // byte budget enforced by garbage collection after each commit, 0 for no limit
+}
+
+// Source records where a stored archive was downloaded from
+type Source struct {
+	URL          string `json:"url"`
+	Digest       string `json:"digest"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// Writer stores an archive while it's being written
+// The digest is only known once all contents are written, so contents go to a
+// temporary file that is moved into place on Commit.
+type Writer struct {
+	store *Store
+	file  *os.File
+	h     hash.Hash
+}
+
+// New returns a store at dir, creating its layout if needed
+func New(dir string) (*Store, error) {
+	for _, d := range []string{filepath.Join(blobsDir, verify.SHA256), sourcesDir, tmpDir, configsDir} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{Dir: dir}, nil
+}
+
+// BlobPath returns the path where an archive with a digest is stored
+func (s *Store) BlobPath(digest verify.Digest) string {
+	return filepath.Join(s.Dir, blobsDir, digest.Algorithm, digest.Hex)
+}
+
+// HasBlob reports whether an archive with a digest is stored
+// Only sha256 digests are used as keys.
+func (s *Store) HasBlob(digest verify.Digest) bool {
+	if digest.Algorithm != verify.SHA256 {
+		return false
+	}
+	_, err := os.Stat(s.BlobPath(digest))
+	return err == nil
+}
+
+// Source returns the record for an archive downloaded from a URL, nil if there is none
+// or the archive is no longer stored
+func (s *Store) Source(url string) (*Source, error) {
+	data, err := ioutil.ReadFile(s.sourcePath(url))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	src := &Source{}
+	if err = json.Unmarshal(data, src); err != nil {
+		return nil, err
+	}
+
+	digest, err := verify.ParseDigest(src.Digest)
+	if err != nil || !s.HasBlob(digest) {
+		return nil, nil
+	}
+	return src, nil
+}
+
+// Create returns a writer to store a new archive
+func (s *Store) Create() (*Writer, error) {
+	file, err := ioutil.TempFile(filepath.Join(s.Dir, tmpDir), "blob")
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{store: s, file: file, h: sha256.New()}, nil
+}
+
+// sourcePath returns the path to the record for a URL
+func (s *Store) sourcePath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(s.Dir, sourcesDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// writeSource records the source of an archive, replacing any previous record
+func (s *Store) writeSource(src *Source) error {
+	return s.writeJSON(s.sourcePath(src.URL), src)
+}
+
+// writeJSON writes a record, replacing any previous one
+func (s *Store) writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// write and rename, so that records are never seen half written
+	tmp, err := ioutil.TempFile(filepath.Join(s.Dir, tmpDir), "record")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Write implements io.Writer
+func (w *Writer) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.h.Write(p[:n])
+	return n, err
+}
+
+// Commit moves written contents into the store and returns their digest
+// If src is not nil it is recorded with the resulting digest. The committed archive is kept
+// by the collection following the commit, even if it alone exceeds MaxSize.
+func (w *Writer) Commit(src *Source) (verify.Digest, error) {
+	digest := verify.Digest{Algorithm: verify.SHA256, Hex: hex.EncodeToString(w.h.Sum(nil))}
+
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return digest, err
+	}
+	if err := os.Rename(w.file.Name(), w.store.BlobPath(digest)); err != nil {
+		os.Remove(w.file.Name())
+		return digest, err
+	}
+
+	if src != nil {
+		src.Digest = digest.String()
+		if err := w.store.writeSource(src); err != nil {
+			return digest, err
+		}
+	}
+
+	if w.store.MaxSize > 0 {
+		// in use while collecting, so that it's never removed by its own commit
+		file, err := w.store.Open(digest)
+		if err != nil {
+			return digest, err
+		}
+		defer file.Close()
+		if _, err = w.store.GC(w.store.MaxSize); err != nil {
+			return digest, err
+		}
+	}
+	return digest, nil
+}
+
+// Abort discards written contents
+func (w *Writer) Abort() error {
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/odacremolbap/fsisolate/oci"
+	"github.com/odacremolbap/fsisolate/verify"
+)
+
+// sha256 for "Die Zeit vergeht wie im Fluge"
+const textSHA256 = "sha256:8879884165e9a6f2d0e6499c7edd1a939e38cca7da9ebdd08ba2aa5b753c8b55"
+
+func TestStoreBlob(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create store directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir)
+	if err != nil {
+		t.Fatalf("Couldn't create store: %s", err)
+	}
+
+	expected, err := verify.ParseDigest(textSHA256)
+	if err != nil {
+		t.Fatalf("Couldn't parse digest: %s", err)
+	}
+
+	// aborted writes are not stored
+	w, err := s.Create()
+	if err != nil {
+		t.Fatalf("Couldn't create store writer: %s", err)
+	}
+	w.Write([]byte("Die Zeit vergeht wie im Fluge"))
+	if err = w.Abort(); err != nil {
+		t.Errorf("Error aborting store writer: %s", err)
+	}
+	if s.HasBlob(expected) {
+		t.Errorf("Aborted contents were stored")
+	}
+
+	w, err = s.Create()
+	if err != nil {
+		t.Fatalf("Couldn't create store writer: %s", err)
+	}
+	w.Write([]byte("Die Zeit vergeht wie im Fluge"))
+	digest, err := w.Commit(&Source{URL: "http://test.url/text", ETag: `"v1"`})
+	if err != nil {
+		t.Fatalf("Error committing store writer: %s", err)
+	}
+
+	if digest != expected {
+		t.Errorf("Stored contents digest is %s but expected %s", digest, expected)
+	}
+	if !s.HasBlob(expected) {
+		t.Errorf("Committed contents were not stored")
+	}
+	content, err := ioutil.ReadFile(s.BlobPath(expected))
+	if err != nil || string(content) != "Die Zeit vergeht wie im Fluge" {
+		t.Errorf("Stored contents are %q (%v)", content, err)
+	}
+
+	var testData = []struct {
+		url    string // source URL
+		etag   string // expected ETag, empty if there should be no record
+		digest string // expected digest
+	}{
+		{"http://test.url/text", `"v1"`, textSHA256},
+		{"http://test.url/other", "", ""},
+	}
+
+	for _, td := range testData {
+
+		src, err := s.Source(td.url)
+		if err != nil {
+			t.Errorf("Error getting source for %q: %s", td.url, err)
+			continue
+		}
+
+		if src == nil {
+			if td.etag != "" {
+				t.Errorf("Source for %q was not recorded", td.url)
+			}
+			continue
+		}
+
+		if src.ETag != td.etag || src.Digest != td.digest {
+			t.Errorf("Source for %q recorded as %+v", td.url, src)
+		}
+	}
+
+	// records for removed blobs are ignored
+	os.Remove(s.BlobPath(expected))
+	if src, err := s.Source("http://test.url/text"); err != nil || src != nil {
+		t.Errorf("Source for a removed blob returned %+v (%v)", src, err)
+	}
+}
+
+func TestStoreConfig(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "fsisolate")
+	if err != nil {
+		t.Fatalf("Couldn't create store directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir)
+	if err != nil {
+		t.Fatalf("Couldn't create store: %s", err)
+	}
+
+	config := &oci.ImageConfig{OS: "linux", Config: oci.ContainerConfig{Cmd: []string{"/bin/sh"}, WorkingDir: "/tmp"}}
+	if err = s.SaveConfig("oci-layout:image", config); err != nil {
+		t.Fatalf("Error saving config: %s", err)
+	}
+
+	var testData = []struct {
+		ref        string // image reference
+		workingDir string // expected working dir, empty if there should be no config
+	}{
+		{"oci-layout:image", "/tmp"},
+		{"oci-layout:other", ""},
+	}
+
+	for _, td := range testData {
+
+		stored, err := s.Config(td.ref)
+		if err != nil {
+			t.Errorf("Error getting config for %q: %s", td.ref, err)
+			continue
+		}
+		if stored == nil {
+			if td.workingDir != "" {
+				t.Errorf("Config for %q was not kept", td.ref)
+			}
+			continue
+		}
+		if stored.Config.WorkingDir != td.workingDir || stored.OS != "linux" {
+			t.Errorf("Config for %q kept as %+v", td.ref, stored)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Package verify checks images integrity and authenticity.
+package verify
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// Digest algorithms supported
+const (
+	SHA256 = "sha256"
+	SHA512 = "sha512"
+)
+
+// Digest is the expected digest for some contents
+type Digest struct {
+	Algorithm string // hash algorithm, sha256 or sha512
+	Hex       string // hexadecimal encoded hash
+}
+
+// DigestMismatchError is returned when contents don't match the expected digest
+type DigestMismatchError struct {
+	Expected Digest
+	Actual   string // hexadecimal encoded hash of the contents read
+}
+
+// Error implements the error interface
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("Digest mismatch: expected %s but contents hash to %s:%s", e.Expected, e.Expected.Algorithm, e.Actual)
+}
+
+// ParseDigest parses a digest in "algorithm:hex" or "algorithm=hex" format
+func ParseDigest(s string) (Digest, error) {
+	i := strings.IndexAny(s, ":=")
+	if i < 0 {
+		return Digest{}, fmt.Errorf("Error parsing digest %q: missing algorithm", s)
+	}
+
+	d := Digest{Algorithm: strings.ToLower(s[:i]), Hex: strings.ToLower(s[i+1:])}
+
+	h, err := d.newHash()
+	if err != nil {
+		return Digest{}, err
+	}
+	if b, err := hex.DecodeString(d.Hex); err != nil || len(b) != h.Size() {
+		return Digest{}, fmt.Errorf("Error parsing digest %q: invalid %s hash", s, d.Algorithm)
+	}
+	return d, nil
+}
+
+// String returns the digest in "algorithm:hex" format
+func (d Digest) String() string {
+	return d.Algorithm + ":" + d.Hex
+}
+
+// newHash returns the hash function for the digest algorithm
+func (d Digest) newHash() (hash.Hash, error) {
+	switch d.Algorithm {
+	case SHA256:
+		return sha256.New(), nil
+	case SHA512:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("Error parsing digest: unsupported algorithm %q", d.Algorithm)
+}
+
+// Reader verifies contents against a digest while they are read
+// Once the underlying stream ends, a DigestMismatchError is returned instead of io.EOF
+// if contents didn't match, so that consumers fail without an extra pass.
+type Reader struct {
+	r        io.Reader
+	h        hash.Hash
+	expected Digest
+}
+
+// NewReader returns a Reader verifying r against the expected digest
+func NewReader(r io.Reader, expected Digest) (*Reader, error) {
+	h, err := expected.newHash()
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: r, h: h, expected: expected}, nil
+}
+
+// Read implements io.Reader
+func (v *Reader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if actual := hex.EncodeToString(v.h.Sum(nil)); actual != v.expected.Hex {
+			return n, &DigestMismatchError{Expected: v.expected, Actual: actual}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,91 @@
+package verify
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// sha256 and sha512 for "Die Zeit vergeht wie im Fluge"
+const (
+	textSHA256 = "8879884165e9a6f2d0e6499c7edd1a939e38cca7da9ebdd08ba2aa5b753c8b55"
+	textSHA512 = "628eaaa6592da6da5a66646e6ca8cf6ef7c0adeb318d51e66d521783d4ff41f4595732b92c4bf6ac876316d7f2220170bf6684192119f6b101848667bd986a55"
+)
+
+func TestParseDigest(t *testing.T) {
+
+	var testData = []struct {
+		digest  string // digest to parse
+		parsed  string // expected digest string
+		parseOK bool   // whether parsing should succeed
+	}{
+		{"sha256:" + strings.Repeat("a", 64), "sha256:" + strings.Repeat("a", 64), true},
+		{"sha256=" + strings.Repeat("A", 64), "sha256:" + strings.Repeat("a", 64), true},
+		{"SHA512:" + strings.Repeat("0", 128), "sha512:" + strings.Repeat("0", 128), true},
+		{"sha256:" + strings.Repeat("a", 63), "", false},
+		{"sha256:" + strings.Repeat("z", 64), "", false},
+		{"md5:" + strings.Repeat("a", 32), "", false},
+		{strings.Repeat("a", 64), "", false},
+	}
+
+	for _, td := range testData {
+
+		d, err := ParseDigest(td.digest)
+		if err != nil {
+			if td.parseOK {
+				t.Errorf("Error parsing digest %q: %s", td.digest, err)
+			}
+			continue
+		}
+
+		if !td.parseOK {
+			t.Errorf("Parsing digest %q should have failed, but did not", td.digest)
+			continue
+		}
+
+		if d.String() != td.parsed {
+			t.Errorf("Digest %q parsed as %q but expected %q", td.digest, d, td.parsed)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+
+	var testData = []struct {
+		digest   string // expected digest
+		verifyOK bool   // whether contents match the digest
+	}{
+		{"sha256:" + textSHA256, true},
+		{"sha512:" + textSHA512, true},
+		{"sha256:" + strings.Repeat("0", 64), false},
+	}
+
+	for _, td := range testData {
+
+		d, err := ParseDigest(td.digest)
+		if err != nil {
+			t.Errorf("Error parsing digest %q: %s", td.digest, err)
+			continue
+		}
+
+		r, err := NewReader(strings.NewReader("Die Zeit vergeht wie im Fluge"), d)
+		if err != nil {
+			t.Errorf("Error creating reader for %q: %s", td.digest, err)
+			continue
+		}
+
+		_, err = ioutil.ReadAll(r)
+		if err != nil {
+			if _, ok := err.(*DigestMismatchError); !ok {
+				t.Errorf("Reading with digest %q returned unexpected error: %s", td.digest, err)
+			} else if td.verifyOK {
+				t.Errorf("Contents should match digest %q: %s", td.digest, err)
+			}
+			continue
+		}
+
+		if !td.verifyOK {
+			t.Errorf("Contents should not match digest %q, but did", td.digest)
+		}
+	}
+}
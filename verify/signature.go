@@ -0,0 +1,164 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisign format constants
+const (
+	untrustedCommentPrefix = "untrusted comment:"
+	trustedCommentPrefix   = "trusted comment: "
+	keyIDSize              = 8
+)
+
+// signature algorithms: legacy signs contents, prehashed signs their BLAKE2b-512 hash
+var (
+	legacyAlgorithm    = []byte("Ed")
+	prehashedAlgorithm = []byte("ED")
+)
+
+// PublicKey is a minisign ed25519 public key trusted to sign images
+type PublicKey struct {
+	ID  [keyIDSize]byte
+	Key ed25519.PublicKey
+}
+
+// Signature is a minisign detached signature
+type Signature struct {
+	KeyID           [keyIDSize]byte
+	Signature       []byte // signature of the contents BLAKE2b-512 hash
+	TrustedComment  string // comment covered by the global signature
+	GlobalSignature []byte // signature of Signature and TrustedComment
+}
+
+// SignatureError is returned when contents signature can't be verified
+type SignatureError struct {
+	Reason string
+}
+
+// Error implements the error interface
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("Signature verification failed: %s", e.Reason)
+}
+
+// ParsePublicKey parses a minisign public key
+// Either the public key file contents or its base64 encoded line are accepted.
+func ParsePublicKey(s string) (PublicKey, error) {
+	var pk PublicKey
+
+	raw, err := base64.StdEncoding.DecodeString(lastLine(s))
+	if err != nil {
+		return pk, fmt.Errorf("Error parsing public key: %s", err.Error())
+	}
+	if len(raw) != len(legacyAlgorithm)+keyIDSize+ed25519.PublicKeySize || !bytes.Equal(raw[:2], legacyAlgorithm) {
+		return pk, fmt.Errorf("Error parsing public key: not an ed25519 minisign key")
+	}
+
+	copy(pk.ID[:], raw[2:2+keyIDSize])
+	pk.Key = ed25519.PublicKey(raw[2+keyIDSize:])
+	return pk, nil
+}
+
+// ParseSignature parses a minisign signature file
+// Only prehashed signatures are supported, since legacy ones need the whole contents in memory.
+func ParseSignature(data []byte) (*Signature, error) {
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], untrustedCommentPrefix) || !strings.HasPrefix(lines[2], trustedCommentPrefix) {
+		return nil, fmt.Errorf("Error parsing signature: unknown format")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing signature: %s", err.Error())
+	}
+	if len(raw) != len(prehashedAlgorithm)+keyIDSize+ed25519.SignatureSize {
+		return nil, fmt.Errorf("Error parsing signature: invalid length")
+	}
+	if !bytes.Equal(raw[:2], prehashedAlgorithm) {
+		return nil, fmt.Errorf("Error parsing signature: unsupported algorithm %q", raw[:2])
+	}
+
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("Error parsing signature: invalid global signature")
+	}
+
+	sig := &Signature{
+		Signature:       raw[2+keyIDSize:],
+		TrustedComment:  strings.TrimSuffix(strings.TrimPrefix(lines[2], trustedCommentPrefix), "\r"),
+		GlobalSignature: global,
+	}
+	copy(sig.KeyID[:], raw[2:2+keyIDSize])
+	return sig, nil
+}
+
+// verify checks a contents hash against the signature using the matching trusted key
+func (s *Signature) verify(hash []byte, keys []PublicKey) error {
+	for _, k := range keys {
+		if k.ID != s.KeyID {
+			continue
+		}
+		if !ed25519.Verify(k.Key, hash, s.Signature) {
+			return &SignatureError{Reason: "contents don't match signature"}
+		}
+		if !ed25519.Verify(k.Key, append(append([]byte{}, s.Signature...), s.TrustedComment...), s.GlobalSignature) {
+			return &SignatureError{Reason: "trusted comment doesn't match signature"}
+		}
+		return nil
+	}
+	return &SignatureError{Reason: fmt.Sprintf("signed with untrusted key %X", reverse(s.KeyID[:]))}
+}
+
+// SignatureReader verifies contents against a detached signature while they are read
+// Once the underlying stream ends, a SignatureError is returned instead of io.EOF
+// if contents are not signed by any of the trusted keys.
+type SignatureReader struct {
+	r    io.Reader
+	h    hash.Hash
+	sig  *Signature
+	keys []PublicKey
+}
+
+// NewSignatureReader returns a SignatureReader verifying r against sig with trusted keys
+func NewSignatureReader(r io.Reader, sig *Signature, keys []PublicKey) (*SignatureReader, error) {
+	h, err := blake2b.New512(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &SignatureReader{r: r, h: h, sig: sig, keys: keys}, nil
+}
+
+// Read implements io.Reader
+func (v *SignatureReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if verr := v.sig.verify(v.h.Sum(nil), v.keys); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+// lastLine returns the last non empty line, skipping minisign comments
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// reverse returns a reversed copy, minisign prints key ids as little endian numbers
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
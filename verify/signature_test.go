@@ -0,0 +1,124 @@
+package verify
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// testKey generates a key pair returning the public key in minisign format
+func testKey(t *testing.T, id string) (string, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't generate key: %s", err)
+	}
+	raw := append(append([]byte("Ed"), id...), pub...)
+	return "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(raw) + "\n", priv
+}
+
+// testSign returns a minisign prehashed signature file for contents
+func testSign(priv ed25519.PrivateKey, id string, contents string) []byte {
+	hash := blake2b.Sum512([]byte(contents))
+	sig := ed25519.Sign(priv, hash[:])
+	comment := "timestamp:1462896000\tfile:image.tar"
+	global := ed25519.Sign(priv, append(append([]byte{}, sig...), comment...))
+	raw := append(append([]byte("ED"), id...), sig...)
+	return []byte(fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(raw), comment, base64.StdEncoding.EncodeToString(global)))
+}
+
+func TestParsePublicKey(t *testing.T) {
+
+	file, _ := testKey(t, "fsisolat")
+
+	var testData = []struct {
+		key     string // public key to parse
+		parseOK bool   // whether parsing should succeed
+	}{
+		{file, true},
+		{strings.Split(file, "\n")[1], true},
+		{"untrusted comment: nothing\n", false},
+		{base64.StdEncoding.EncodeToString([]byte("Ed12345678short")), false},
+	}
+
+	for _, td := range testData {
+
+		pk, err := ParsePublicKey(td.key)
+		if err != nil {
+			if td.parseOK {
+				t.Errorf("Error parsing public key %q: %s", td.key, err)
+			}
+			continue
+		}
+
+		if !td.parseOK {
+			t.Errorf("Parsing public key %q should have failed, but did not", td.key)
+			continue
+		}
+
+		if string(pk.ID[:]) != "fsisolat" {
+			t.Errorf("Public key %q parsed with id %q but expected %q", td.key, pk.ID, "fsisolat")
+		}
+	}
+}
+
+func TestSignatureReader(t *testing.T) {
+
+	trustedFile, trustedPriv := testKey(t, "trusted0")
+	_, untrustedPriv := testKey(t, "untrust0")
+	trusted, err := ParsePublicKey(trustedFile)
+	if err != nil {
+		t.Fatalf("Couldn't parse trusted key: %s", err)
+	}
+
+	contents := "Die Zeit vergeht wie im Fluge"
+	tampered := testSign(trustedPriv, "trusted0", contents)
+	tampered = []byte(strings.Replace(string(tampered), "file:image.tar", "file:other.tar", 1))
+
+	var testData = []struct {
+		signature []byte // signature file
+		contents  string // contents read
+		verifyOK  bool   // whether verification should succeed
+	}{
+		{testSign(trustedPriv, "trusted0", contents), contents, true},
+		{testSign(trustedPriv, "trusted0", contents), contents + "!", false},
+		{testSign(untrustedPriv, "untrust0", contents), contents, false},
+		{testSign(untrustedPriv, "trusted0", contents), contents, false},
+		{tampered, contents, false},
+	}
+
+	for i, td := range testData {
+
+		sig, err := ParseSignature(td.signature)
+		if err != nil {
+			t.Errorf("Error parsing signature for case %d: %s", i, err)
+			continue
+		}
+
+		r, err := NewSignatureReader(strings.NewReader(td.contents), sig, []PublicKey{trusted})
+		if err != nil {
+			t.Errorf("Error creating signature reader for case %d: %s", i, err)
+			continue
+		}
+
+		_, err = ioutil.ReadAll(r)
+		if err != nil {
+			if _, ok := err.(*SignatureError); !ok {
+				t.Errorf("Verifying case %d returned unexpected error: %s", i, err)
+			} else if td.verifyOK {
+				t.Errorf("Signature for case %d should be valid: %s", i, err)
+			}
+			continue
+		}
+
+		if !td.verifyOK {
+			t.Errorf("Signature for case %d should not be valid, but was", i)
+		}
+	}
+}